@@ -0,0 +1,82 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+const (
+	RolePlayer    = "player"
+	RoleModerator = "moderator"
+	RoleAdmin     = "admin"
+)
+
+var roleRanks = map[string]int{
+	RolePlayer:    1,
+	RoleModerator: 2,
+	RoleAdmin:     3,
+}
+
+// reservedPlayerIDs are the ids the engine gives special powers to, only ever
+// used by the server itself
+var reservedPlayerIDs = map[string]bool{
+	"admin":  true,
+	"engine": true,
+}
+
+// hasRole reports whether the authenticated player has at least the role
+func hasRole(ctx context.Context, role string) bool {
+	playerRole, _ := ctx.Value("playerRole").(string)
+	return roleRanks[playerRole] >= roleRanks[role] && roleRanks[playerRole] > 0
+}
+
+// Authenticate puts the playerID, role and sessionID of the session behind
+// the bearer token or shsid cookie into the request context
+func (ah *APIHandler) Authenticate(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		playerID := ""
+		playerRole := ""
+		sessionID := ""
+		var session *Session
+		if h := r.Header.Get("Authorization"); h != "" && len(h) > 7 {
+			session, _ = ah.Sessions.Get(h[7:])
+		}
+		if c, err := r.Cookie("shsid"); err == nil && session == nil {
+			session, _ = ah.Sessions.Get(c.Value)
+		}
+		if session != nil {
+			playerID = session.PlayerID
+			playerRole = session.Role
+			sessionID = session.ID
+		}
+		//Testing identities never get more than the player role, nor the ids
+		//the engine trusts
+		if ah.Config.TestingMode && playerID == "" {
+			playerID = r.URL.Query().Get("playerID")
+			playerRole = RolePlayer
+			if reservedPlayerIDs[playerID] {
+				WriteError(w, NewAPIError(http.StatusForbidden, CodeForbidden, "Reserved playerID"))
+				return
+			}
+		}
+		if playerID != "" {
+			AddLogFields(r, "playerID", playerID)
+		}
+		ctx := context.WithValue(r.Context(), "playerID", playerID)
+		ctx = context.WithValue(ctx, "playerRole", playerRole)
+		ctx = context.WithValue(ctx, "sessionID", sessionID)
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// PromotePlayer makes the player with the email an admin
+func PromotePlayer(store Store, email string) error {
+	p, err := store.FindPlayerByEmail(email)
+	if err != nil {
+		return fmt.Errorf("finding %s: %v", strings.TrimSpace(email), err)
+	}
+	p.Role = RoleAdmin
+	return store.PutPlayer(p)
+}
@@ -0,0 +1,289 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+var (
+	boltPlayers  = []byte("players")
+	boltMeta     = []byte("meta")
+	boltSessions = []byte("sessions")
+	boltLogs     = []byte("logs")
+)
+
+// BoltStore keeps everything in a single embedded bbolt database file
+type BoltStore struct {
+	db *bolt.DB
+}
+
+func NewBoltStore(dir string) (*BoltStore, error) {
+	if err := os.MkdirAll(dir, os.ModePerm); err != nil {
+		return nil, err
+	}
+	db, err := bolt.Open(filepath.Join(dir, "secrethitler.db"), 0600, nil)
+	if err != nil {
+		return nil, err
+	}
+	err = db.Update(func(tx *bolt.Tx) error {
+		for _, b := range [][]byte{boltPlayers, boltMeta, boltLogs, boltSessions} {
+			if _, err := tx.CreateBucketIfNotExists(b); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	return &BoltStore{db: db}, nil
+}
+
+func (bs *BoltStore) GetPlayer(id string) (*Player, error) {
+	p := Player{}
+	err := bs.db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket(boltPlayers).Get([]byte(id))
+		if b == nil {
+			return ErrNotFound
+		}
+		return json.Unmarshal(b, &p)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &p, nil
+}
+
+func (bs *BoltStore) FindPlayerByEmail(email string) (*Player, error) {
+	var ret *Player
+	email = strings.TrimSpace(email)
+	err := bs.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(boltPlayers).ForEach(func(k, v []byte) error {
+			p := Player{}
+			if err := json.Unmarshal(v, &p); err != nil {
+				return err
+			}
+			if strings.EqualFold(strings.TrimSpace(p.Email), email) {
+				ret = &p
+			}
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+	if ret == nil {
+		return nil, ErrNotFound
+	}
+	return ret, nil
+}
+
+func (bs *BoltStore) PutPlayer(p *Player) error {
+	b, err := json.Marshal(p)
+	if err != nil {
+		return err
+	}
+	return bs.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(boltPlayers).Put([]byte(p.ID), b)
+	})
+}
+
+func (bs *BoltStore) DeletePlayer(id string) error {
+	return bs.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(boltPlayers)
+		if b.Get([]byte(id)) == nil {
+			return ErrNotFound
+		}
+		return b.Delete([]byte(id))
+	})
+}
+
+func (bs *BoltStore) Sessions() ([]*Session, error) {
+	ret := []*Session{}
+	err := bs.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(boltSessions).ForEach(func(k, v []byte) error {
+			s := Session{}
+			if err := json.Unmarshal(v, &s); err != nil {
+				return err
+			}
+			ret = append(ret, &s)
+			return nil
+		})
+	})
+	return ret, err
+}
+
+func (bs *BoltStore) PutSession(s *Session) error {
+	b, err := json.Marshal(s)
+	if err != nil {
+		return err
+	}
+	return bs.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(boltSessions).Put([]byte(s.ID), b)
+	})
+}
+
+func (bs *BoltStore) DeleteSession(id string) error {
+	return bs.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(boltSessions).Delete([]byte(id))
+	})
+}
+
+func (bs *BoltStore) GetGameMeta(gameID string) (*GameMeta, error) {
+	m := GameMeta{}
+	err := bs.db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket(boltMeta).Get([]byte(gameID))
+		if b == nil {
+			return ErrNotFound
+		}
+		return json.Unmarshal(b, &m)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &m, nil
+}
+
+func (bs *BoltStore) PutGameMeta(m *GameMeta) error {
+	b, err := json.Marshal(m)
+	if err != nil {
+		return err
+	}
+	return bs.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(boltMeta).Put([]byte(m.ID), b)
+	})
+}
+
+func (bs *BoltStore) GameIDs() ([]string, error) {
+	ret := []string{}
+	err := bs.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(boltLogs).ForEach(func(k, v []byte) error {
+			ret = append(ret, string(k))
+			return nil
+		})
+	})
+	return ret, err
+}
+
+func (bs *BoltStore) EventLog(gameID string) io.Writer {
+	return &boltLogWriter{db: bs.db, gameID: []byte(gameID)}
+}
+
+func (bs *BoltStore) OpenEventLog(gameID string, offset int) (io.ReadCloser, error) {
+	var buf bytes.Buffer
+	err := bs.db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket(boltLogs).Bucket([]byte(gameID))
+		if b == nil {
+			return ErrNotFound
+		}
+		c := b.Cursor()
+		for k, v := c.Seek(boltSeq(uint64(offset) + 1)); k != nil; k, v = c.Next() {
+			buf.Write(v)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return ioutil.NopCloser(&buf), nil
+}
+
+func (bs *BoltStore) RewriteEventLog(gameID string, fn func(line []byte) []byte) error {
+	return bs.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(boltLogs).Bucket([]byte(gameID))
+		if b == nil {
+			return ErrNotFound
+		}
+		updates := map[string][]byte{}
+		err := b.ForEach(func(k, v []byte) error {
+			if nv := fn(v); !bytes.Equal(nv, v) {
+				updates[string(k)] = nv
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		for k, v := range updates {
+			if err := b.Put([]byte(k), v); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (bs *BoltStore) Sync() error {
+	return bs.db.Sync()
+}
+
+func (bs *BoltStore) Ping() error {
+	return bs.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(boltMeta)
+		if err := b.Put([]byte(".ping"), []byte{}); err != nil {
+			return err
+		}
+		return b.Delete([]byte(".ping"))
+	})
+}
+
+func (bs *BoltStore) Close() error {
+	return bs.db.Close()
+}
+
+// boltLogWriter stores every complete line written to it as its own entry
+// in the bucket of the game, keyed by sequence
+type boltLogWriter struct {
+	db      *bolt.DB
+	gameID  []byte
+	m       sync.Mutex
+	partial []byte
+}
+
+func (w *boltLogWriter) Write(p []byte) (int, error) {
+	w.m.Lock()
+	defer w.m.Unlock()
+	buf := append(w.partial, p...)
+	i := bytes.LastIndexByte(buf, '\n')
+	if i < 0 {
+		w.partial = buf
+		return len(p), nil
+	}
+	lines := buf[:i+1]
+	err := w.db.Update(func(tx *bolt.Tx) error {
+		b, err := tx.Bucket(boltLogs).CreateBucketIfNotExists(w.gameID)
+		if err != nil {
+			return err
+		}
+		for len(lines) > 0 {
+			j := bytes.IndexByte(lines, '\n')
+			seq, _ := b.NextSequence()
+			if err := b.Put(boltSeq(seq), lines[:j+1]); err != nil {
+				return err
+			}
+			lines = lines[j+1:]
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	w.partial = append([]byte(nil), buf[i+1:]...)
+	return len(p), nil
+}
+
+func boltSeq(seq uint64) []byte {
+	b := make([]byte, 8)
+	binary.BigEndian.PutUint64(b, seq)
+	return b
+}
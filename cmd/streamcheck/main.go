@@ -0,0 +1,303 @@
+// Command streamcheck hammers a game on a running server with concurrent
+// events while clients keep dropping and resuming the event stream with
+// Last-Event-Id, then checks every client saw every event exactly once and in
+// order.
+//
+// TestStreamsHaveNoGaps runs the same check against an in-process server as
+// part of go test, this points it at a deployed one.
+//
+// The server has to run with -testing, so players can be picked with
+// ?playerID=, and -rate-limits=false.
+//
+//	streamcheck -url http://localhost:8080 -players 5 -events 200 -clients 8
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"math/rand"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+func main() {
+	base := flag.String("url", "http://localhost:8080", "The server to check")
+	players := flag.Int("players", 5, "Players submitting events at once")
+	events := flag.Int("events", 200, "Events each player submits")
+	clients := flag.Int("clients", 8, "Clients following the event stream")
+	maxFrames := flag.Int("reconnect", 25, "Most events a client reads before dropping the connection")
+	timeout := flag.Duration("timeout", 2*time.Minute, "Give up after this long")
+	flag.Parse()
+
+	ctx, cancel := context.WithTimeout(context.Background(), *timeout)
+	defer cancel()
+
+	gameID, err := createGame(*base)
+	if err != nil {
+		fail("create game: %v", err)
+	}
+	fmt.Println("game", gameID)
+	for i := 0; i < *players; i++ {
+		pid := "p" + strconv.Itoa(i)
+		if err := submit(*base, gameID, pid, map[string]interface{}{"type": "player.join", "player": map[string]string{"id": pid}}); err != nil {
+			fail("join %s: %v", pid, err)
+		}
+	}
+
+	//Clients start following before the flood, and keep reconnecting through it
+	done := make(chan struct{})
+	results := make([][]frame, *clients)
+	cwg := sync.WaitGroup{}
+	for i := 0; i < *clients; i++ {
+		cwg.Add(1)
+		go func(i int) {
+			defer cwg.Done()
+			results[i] = follow(ctx, *base, gameID, "c"+strconv.Itoa(i), *maxFrames, done)
+		}(i)
+	}
+
+	swg := sync.WaitGroup{}
+	for i := 0; i < *players; i++ {
+		swg.Add(1)
+		go func(pid string) {
+			defer swg.Done()
+			for n := 0; n < *events; n++ {
+				err := submit(*base, gameID, pid, map[string]interface{}{"type": "player.message", "playerId": pid, "message": strconv.Itoa(n)})
+				if err != nil {
+					fail("submit %s %d: %v", pid, n, err)
+				}
+			}
+		}("p" + strconv.Itoa(i))
+	}
+	swg.Wait()
+
+	last, err := lastEventID(*base, gameID)
+	if err != nil {
+		fail("get game: %v", err)
+	}
+	fmt.Println("last event", last)
+	//Give the clients until they've caught up to the last event
+	close(done)
+	finish := make(chan struct{})
+	go func() {
+		cwg.Wait()
+		close(finish)
+	}()
+	select {
+	case <-finish:
+	case <-ctx.Done():
+		fail("clients didn't catch up before the timeout")
+	}
+
+	ok := true
+	for i, frames := range results {
+		resyncs := 0
+		for _, f := range frames {
+			if f.Resync {
+				resyncs++
+			}
+		}
+		if problems := check(frames, last); len(problems) > 0 {
+			ok = false
+			fmt.Printf("c%d: %d events, %d resyncs, %s\n", i, len(frames)-resyncs, resyncs, strings.Join(problems, ", "))
+		} else {
+			fmt.Printf("c%d: %d events, %d resyncs, ok\n", i, len(frames)-resyncs, resyncs)
+		}
+	}
+	if !ok {
+		os.Exit(1)
+	}
+}
+
+// frame is an event a client saw, or a resync that skipped it ahead to the
+// state after the event with that id
+type frame struct {
+	ID     int
+	Resync bool
+}
+
+func fail(format string, args ...interface{}) {
+	fmt.Fprintf(os.Stderr, format+"\n", args...)
+	os.Exit(1)
+}
+
+func createGame(base string) (string, error) {
+	resp, err := http.Post(base+"/api/games/?playerID=host", "application/json", strings.NewReader("{}"))
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	g := struct {
+		ID string `json:"id"`
+	}{}
+	if err := json.NewDecoder(resp.Body).Decode(&g); err != nil {
+		return "", err
+	}
+	return g.ID, nil
+}
+
+func lastEventID(base, gameID string) (int, error) {
+	resp, err := http.Get(base + "/api/games/" + gameID + "?playerID=host")
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	g := struct {
+		EventID int `json:"eventId"`
+	}{}
+	err = json.NewDecoder(resp.Body).Decode(&g)
+	return g.EventID, err
+}
+
+func submit(base, gameID, playerID string, e map[string]interface{}) error {
+	b, _ := json.Marshal(e)
+	resp, err := http.Post(base+"/api/games/"+gameID+"/events?playerID="+url.QueryEscape(playerID), "application/json", bytes.NewReader(b))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		body := new(bytes.Buffer)
+		body.ReadFrom(resp.Body)
+		return fmt.Errorf("%s: %s", resp.Status, strings.TrimSpace(body.String()))
+	}
+	return nil
+}
+
+// follow reads the event stream a few events at a time, reconnecting with the
+// last id it saw, until done is closed and it has caught up
+func follow(ctx context.Context, base, gameID, playerID string, maxFrames int, done chan struct{}) []frame {
+	frames := []frame{}
+	leid := 0
+	target := -1
+	for ctx.Err() == nil {
+		select {
+		case <-done:
+			if target < 0 {
+				target, _ = lastEventID(base, gameID)
+			}
+		default:
+		}
+		if target >= 0 && leid >= target {
+			return frames
+		}
+		n := 1 + rand.Intn(maxFrames)
+		//Once done, read until caught up rather than dropping again
+		if target >= 0 {
+			n = -1
+		}
+		got, err := read(ctx, base, gameID, playerID, leid, n, target, done)
+		frames = append(frames, got...)
+		if len(got) > 0 {
+			leid = got[len(got)-1].ID
+		}
+		select {
+		case <-done:
+			//Hung up on purpose to catch up
+		default:
+			if err != nil && ctx.Err() == nil {
+				fmt.Fprintf(os.Stderr, "%s: %v\n", playerID, err)
+				time.Sleep(100 * time.Millisecond)
+			}
+		}
+	}
+	return frames
+}
+
+// read connects once, returning the events read. It hangs up
+// after n events, or once it reaches the target when n is negative. Waiting
+// for n events ends when done is closed, since no more may come.
+func read(ctx context.Context, base, gameID, playerID string, leid, n, target int, done chan struct{}) ([]frame, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	if n > 0 {
+		go func() {
+			select {
+			case <-done:
+				cancel()
+			case <-ctx.Done():
+			}
+		}()
+	}
+	req, _ := http.NewRequest(http.MethodGet, base+"/api/games/"+gameID+"/events?playerID="+url.QueryEscape(playerID), nil)
+	req = req.WithContext(ctx)
+	if leid > 0 {
+		req.Header.Set("Last-Event-Id", strconv.Itoa(leid))
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%s", resp.Status)
+	}
+
+	frames := []frame{}
+	id, event := 0, ""
+	s := bufio.NewScanner(resp.Body)
+	s.Buffer(make([]byte, 64*1024), 1024*1024)
+	for s.Scan() {
+		line := s.Text()
+		switch {
+		case strings.HasPrefix(line, "id: "):
+			id, _ = strconv.Atoi(line[4:])
+		case strings.HasPrefix(line, "event: "):
+			event = line[7:]
+		case line == "":
+			//Player profiles and states share the id of their event
+			if event != "" && event != "player" && event != "state" && !strings.HasPrefix(event, "server.") {
+				frames = append(frames, frame{ID: id, Resync: event == "stream.resync"})
+				if n > 0 && len(frames) >= n {
+					return frames, nil
+				}
+				if n < 0 && id >= target {
+					return frames, nil
+				}
+			}
+			id, event = 0, ""
+		}
+	}
+	return frames, s.Err()
+}
+
+// check looks for gaps, repeats and reordering in the events a client saw.
+// Only a resync may skip ahead.
+func check(frames []frame, last int) []string {
+	problems := []string{}
+	if len(frames) == 0 {
+		return []string{"no events"}
+	}
+	seen := map[int]bool{}
+	prev := 0
+	for i, f := range frames {
+		if f.Resync {
+			if i > 0 && f.ID < prev {
+				problems = append(problems, fmt.Sprintf("resync to %d after %d", f.ID, prev))
+			}
+			prev = f.ID
+			continue
+		}
+		if seen[f.ID] {
+			problems = append(problems, fmt.Sprintf("event %d twice", f.ID))
+		}
+		seen[f.ID] = true
+		if i > 0 && f.ID != prev+1 {
+			problems = append(problems, fmt.Sprintf("%d after %d", f.ID, prev))
+		}
+		prev = f.ID
+	}
+	if prev != last {
+		problems = append(problems, fmt.Sprintf("ended at %d not %d", prev, last))
+	}
+	return problems
+}
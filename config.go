@@ -0,0 +1,245 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	yaml "gopkg.in/yaml.v2"
+)
+
+// Config is everything that can differ between deployments. Each setting is
+// a flag, an SH_ environment variable (SH_DATA for -data) and a key in the
+// yaml file given to -config, with flags beating the environment beating the file.
+type Config struct {
+	ConfigFile string
+
+	Listen    string
+	DataDir   string
+	StaticDir string
+	Store     string
+	TLSCert   string
+	TLSKey    string
+	//RedirectHTTP is an extra plain http address that redirects to https
+	RedirectHTTP string
+
+	TestingMode     bool
+	CORSOrigins     stringList
+	CORSCredentials bool
+	CORSMaxAge      time.Duration
+	LogLevel        string
+
+	ShutdownTimeout time.Duration
+	RestartRetry    time.Duration
+	//StreamBuffer is how many events a subscriber can fall behind by before
+	//it is resynced
+	StreamBuffer int
+
+	SessionTTL      time.Duration
+	PersistSessions bool
+
+	RateLimits       bool
+	LoginMaxFailures int
+	LoginLockout     time.Duration
+
+	NameTheme       string
+	NameSeed        int64
+	Profiles        string
+	GravatarTimeout time.Duration
+
+	PromoteAdmin string
+}
+
+// stringList is a comma separated flag
+type stringList []string
+
+func (sl *stringList) String() string {
+	return strings.Join(*sl, ",")
+}
+
+func (sl *stringList) Set(s string) error {
+	*sl = nil
+	for _, v := range strings.Split(s, ",") {
+		if v = strings.TrimSpace(v); v != "" {
+			*sl = append(*sl, v)
+		}
+	}
+	return nil
+}
+
+func (c *Config) flagSet(name string) *flag.FlagSet {
+	fs := flag.NewFlagSet(name, flag.ContinueOnError)
+	fs.StringVar(&c.ConfigFile, "config", "", "Yaml file to read settings from")
+	fs.StringVar(&c.Listen, "listen", ":8080", "Address to serve on")
+	fs.StringVar(&c.DataDir, "data", ".", "Directory to keep players, games and the database in")
+	fs.StringVar(&c.StaticDir, "static", "www", "Directory of the web client")
+	fs.StringVar(&c.Store, "store", "file", "Storage backend (file or bolt)")
+	fs.StringVar(&c.TLSCert, "tls-cert", "", "Certificate file to serve https with")
+	fs.StringVar(&c.TLSKey, "tls-key", "", "Key file for -tls-cert")
+	fs.StringVar(&c.RedirectHTTP, "redirect-http", "", "Address to redirect plain http from when serving https, e.g. :80")
+	fs.BoolVar(&c.TestingMode, "testing", false, "Let requests pick their player with ?playerID=")
+	fs.Var(&c.CORSOrigins, "cors-origins", "Comma separated origins allowed to call the api, * for any")
+	fs.BoolVar(&c.CORSCredentials, "cors-credentials", false, "Let allowed origins send cookies and Authorization headers")
+	fs.DurationVar(&c.CORSMaxAge, "cors-max-age", 10*time.Minute, "How long browsers may cache a preflight response")
+	fs.StringVar(&c.LogLevel, "log-level", "info", "Least severe level to log (debug, info, warn or error)")
+	fs.DurationVar(&c.ShutdownTimeout, "shutdown-timeout", 30*time.Second, "How long to wait for requests to finish when stopping")
+	fs.DurationVar(&c.RestartRetry, "restart-retry", 3*time.Second, "How long event streams are told to wait before reconnecting after a restart")
+	fs.IntVar(&c.StreamBuffer, "stream-buffer", 256, "Events queued for a slow event stream or socket before it is dropped back to the current state")
+	fs.DurationVar(&c.SessionTTL, "session-ttl", 72*time.Hour, "How long an unused session stays logged in")
+	fs.BoolVar(&c.PersistSessions, "persist-sessions", false, "Keep sessions in the store so restarts don't log everyone out")
+	fs.BoolVar(&c.RateLimits, "rate-limits", true, "Limit how fast clients can log in, register and post events")
+	fs.IntVar(&c.LoginMaxFailures, "login-max-failures", 5, "Failed logins in a row before an account is locked out")
+	fs.DurationVar(&c.LoginLockout, "login-lockout", 15*time.Minute, "How long an account stays locked out after too many failed logins")
+	fs.StringVar(&c.NameTheme, "name-theme", "parliament", "Word list for generated game names (parliament or noir)")
+	fs.Int64Var(&c.NameSeed, "name-seed", 0, "Seed for generated game names, 0 picks a random seed")
+	fs.StringVar(&c.Profiles, "profiles", "gravatar", "Where new player profiles come from (local or gravatar)")
+	fs.DurationVar(&c.GravatarTimeout, "gravatar-timeout", 3*time.Second, "How long to wait on gravatar.com before using a local profile")
+	fs.StringVar(&c.PromoteAdmin, "promote-admin", "", "Make the player with this email an admin, then exit")
+	return fs
+}
+
+// envName is the environment variable for a flag, SH_SESSION_TTL for -session-ttl
+func envName(flagName string) string {
+	return "SH_" + strings.ToUpper(strings.Replace(flagName, "-", "_", -1))
+}
+
+// LoadConfig builds the config from the file, environment and command line
+// args (without the program name), then validates it
+func LoadConfig(args []string) (*Config, error) {
+	c := new(Config)
+	c.CORSOrigins = stringList{"*"}
+	fs := c.flagSet("sh")
+
+	//The file has to be read first, so find it before parsing anything else
+	configFile := os.Getenv(envName("config"))
+	for i, arg := range args {
+		arg = strings.TrimLeft(arg, "-")
+		if arg == "config" && i+1 < len(args) {
+			configFile = args[i+1]
+		} else if strings.HasPrefix(arg, "config=") {
+			configFile = strings.TrimPrefix(arg, "config=")
+		}
+	}
+	if configFile != "" {
+		if err := c.loadFile(fs, configFile); err != nil {
+			return nil, err
+		}
+	}
+
+	var err error
+	fs.VisitAll(func(f *flag.Flag) {
+		if v, ok := os.LookupEnv(envName(f.Name)); ok && err == nil {
+			if serr := fs.Set(f.Name, v); serr != nil {
+				err = fmt.Errorf("%s: %v", envName(f.Name), serr)
+			}
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if err := fs.Parse(args); err != nil {
+		return nil, err
+	}
+	return c, c.Validate()
+}
+
+func (c *Config) loadFile(fs *flag.FlagSet, name string) error {
+	b, err := ioutil.ReadFile(name)
+	if err != nil {
+		return err
+	}
+	settings := map[string]interface{}{}
+	if err := yaml.Unmarshal(b, &settings); err != nil {
+		return fmt.Errorf("%s: %v", name, err)
+	}
+	for k, v := range settings {
+		if fs.Lookup(k) == nil || k == "config" {
+			return fmt.Errorf("%s: unknown setting %q", name, k)
+		}
+		s := fmt.Sprint(v)
+		if l, ok := v.([]interface{}); ok {
+			items := make([]string, len(l))
+			for i := range l {
+				items[i] = fmt.Sprint(l[i])
+			}
+			s = strings.Join(items, ",")
+		}
+		if err := fs.Set(k, s); err != nil {
+			return fmt.Errorf("%s: %s: %v", name, k, err)
+		}
+	}
+	return nil
+}
+
+// Validate checks the settings make sense together before anything starts
+func (c *Config) Validate() error {
+	errs := []string{}
+	if c.Listen == "" {
+		errs = append(errs, "listen is required")
+	}
+	if c.Store != "file" && c.Store != "bolt" {
+		errs = append(errs, "store must be file or bolt")
+	}
+	if fi, err := os.Stat(c.StaticDir); err != nil || !fi.IsDir() {
+		errs = append(errs, "static must be a directory")
+	}
+	if (c.TLSCert == "") != (c.TLSKey == "") {
+		errs = append(errs, "tls-cert and tls-key must be set together")
+	}
+	if c.RedirectHTTP != "" && c.TLSCert == "" {
+		errs = append(errs, "redirect-http needs tls-cert and tls-key")
+	}
+	for _, f := range []string{c.TLSCert, c.TLSKey} {
+		if _, err := os.Stat(f); f != "" && err != nil {
+			errs = append(errs, err.Error())
+		}
+	}
+	for _, o := range c.CORSOrigins {
+		if u, err := url.Parse(o); o != "*" && (err != nil || u.Scheme == "" || u.Host == "") {
+			errs = append(errs, "cors-origins must be * or origins like https://example.com, not "+o)
+		}
+		if o == "*" && c.CORSCredentials {
+			errs = append(errs, "cors-credentials needs cors-origins to list the origins, not *")
+		}
+	}
+	if c.CORSMaxAge < 0 {
+		errs = append(errs, "cors-max-age can't be negative")
+	}
+	if _, err := ParseLevel(c.LogLevel); err != nil {
+		errs = append(errs, "log-level must be debug, info, warn or error")
+	}
+	if c.ShutdownTimeout <= 0 {
+		errs = append(errs, "shutdown-timeout must be positive")
+	}
+	if c.RestartRetry < 0 {
+		errs = append(errs, "restart-retry can't be negative")
+	}
+	if c.StreamBuffer < 1 {
+		errs = append(errs, "stream-buffer must be at least 1")
+	}
+	if c.LoginMaxFailures <= 0 {
+		errs = append(errs, "login-max-failures must be positive")
+	}
+	if c.LoginLockout < 0 {
+		errs = append(errs, "login-lockout can't be negative")
+	}
+	if c.SessionTTL <= 0 {
+		errs = append(errs, "session-ttl must be positive")
+	}
+	if _, ok := nameThemes[c.NameTheme]; !ok {
+		errs = append(errs, "unknown name-theme "+c.NameTheme)
+	}
+	if c.Profiles != "local" && c.Profiles != "gravatar" {
+		errs = append(errs, "profiles must be local or gravatar")
+	}
+	if len(errs) > 0 {
+		return errors.New("invalid config: " + strings.Join(errs, "; "))
+	}
+	return nil
+}
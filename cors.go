@@ -0,0 +1,71 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// corsAllowHeaders are the request headers the api reads
+var corsAllowHeaders = []string{"Authorization", "Content-Type", "Last-Event-Id"}
+
+// corsExposeHeaders are the response headers clients on other origins may read
+var corsExposeHeaders = []string{"Allow", "Location", "Retry-After", "X-Request-Id"}
+
+// allowedOrigin is the value for Access-Control-Allow-Origin, "" if the origin
+// isn't in the allow list
+func (ah *APIHandler) allowedOrigin(origin string) string {
+	for _, o := range ah.Config.CORSOrigins {
+		//Credentials are never allowed along with *, see Config.Validate
+		if o == "*" || o == origin {
+			return o
+		}
+	}
+	return ""
+}
+
+// cors adds the CORS headers for allowed origins and answers preflight
+// requests for every api route before they reach authentication
+func (ah *APIHandler) cors(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		origin := r.Header.Get("Origin")
+		w.Header().Add("Vary", "Origin")
+		if origin == "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+		allowed := ah.allowedOrigin(origin)
+		if allowed != "" {
+			w.Header().Set("Access-Control-Allow-Origin", allowed)
+			if ah.Config.CORSCredentials {
+				w.Header().Set("Access-Control-Allow-Credentials", "true")
+			}
+		}
+
+		preflight := r.Method == http.MethodOptions && r.Header.Get("Access-Control-Request-Method") != ""
+		if !preflight {
+			if allowed != "" {
+				w.Header().Set("Access-Control-Expose-Headers", strings.Join(corsExposeHeaders, ", "))
+			}
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		w.Header().Add("Vary", "Access-Control-Request-Method")
+		w.Header().Add("Vary", "Access-Control-Request-Headers")
+		w.Header().Set("Content-Type", "application/json")
+		methods := ah.router.Methods(r.URL.Path)
+		if len(methods) == 0 {
+			WriteError(w, NewAPIError(http.StatusNotFound, CodeNotFound, "Not Found"))
+			return
+		}
+		if allowed == "" {
+			WriteError(w, NewAPIError(http.StatusForbidden, CodeOriginNotAllowed, "Origin Not Allowed"))
+			return
+		}
+		w.Header().Set("Access-Control-Allow-Methods", strings.Join(methods, ", "))
+		w.Header().Set("Access-Control-Allow-Headers", strings.Join(corsAllowHeaders, ", "))
+		w.Header().Set("Access-Control-Max-Age", strconv.Itoa(int(ah.Config.CORSMaxAge.Seconds())))
+		w.WriteHeader(http.StatusNoContent)
+	})
+}
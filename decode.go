@@ -0,0 +1,116 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"sort"
+	"strings"
+)
+
+// Request body limits, events and logins are small, an admin overriding a
+// game sends the whole state
+const (
+	maxSmallBody = 16 << 10
+	maxGameBody  = 256 << 10
+)
+
+var errBodyTooLarge = errors.New("request body too large")
+
+// FieldError is a request that decoded fine but has a field that doesn't
+// make sense, or one that couldn't be decoded at all
+type FieldError struct {
+	Field   string
+	Message string
+}
+
+func (fe *FieldError) Error() string {
+	return fe.Field + " " + fe.Message
+}
+
+// limitBody caps the size of the request body for a route
+func limitBody(n int64, h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		r.Body = http.MaxBytesReader(w, r.Body, n)
+		h(w, r)
+	}
+}
+
+// readBody reads the whole (limited) body
+func readBody(r *http.Request) ([]byte, error) {
+	b, err := ioutil.ReadAll(r.Body)
+	if err != nil && isTooLarge(err) {
+		return nil, errBodyTooLarge
+	}
+	return b, err
+}
+
+func isTooLarge(err error) bool {
+	return strings.Contains(err.Error(), "request body too large")
+}
+
+// hasJSONBody reports whether the request has a body at all, chunked ones
+// included, and answers with an error when it does but isn't json. The
+// length is checked rather than the body, which limitBody has wrapped.
+func hasJSONBody(r *http.Request) (bool, error) {
+	if r.Body == nil || r.Body == http.NoBody || r.ContentLength == 0 {
+		return false, nil
+	}
+	mt, _, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if err != nil || mt != "application/json" {
+		return true, NewAPIError(http.StatusUnsupportedMediaType, CodeUnsupportedMedia, "Unsupported Media Type")
+	}
+	return true, nil
+}
+
+// decodeJSON decodes the body into v, refusing unknown fields and anything
+// after the object, turning decode errors into FieldErrors where it can
+func decodeJSON(r *http.Request, v interface{}) error {
+	d := json.NewDecoder(r.Body)
+	d.DisallowUnknownFields()
+	err := d.Decode(v)
+	if err == nil && d.More() {
+		return NewAPIError(http.StatusBadRequest, CodeInvalidJSON, "unexpected data after the json object")
+	}
+	switch e := err.(type) {
+	case nil:
+		return nil
+	case *json.UnmarshalTypeError:
+		return &FieldError{Field: e.Field, Message: "must be " + e.Type.String()}
+	case *json.SyntaxError:
+		return NewAPIError(http.StatusBadRequest, CodeInvalidJSON, fmt.Sprintf("invalid json at offset %d: %v", e.Offset, e))
+	}
+	if err == io.EOF {
+		return NewAPIError(http.StatusBadRequest, CodeInvalidJSON, "request body is required")
+	}
+	if err == io.ErrUnexpectedEOF {
+		return NewAPIError(http.StatusBadRequest, CodeInvalidJSON, "invalid json: the body ends early")
+	}
+	if isTooLarge(err) {
+		return errBodyTooLarge
+	}
+	if msg := err.Error(); strings.HasPrefix(msg, "json: unknown field ") {
+		field := strings.Trim(strings.TrimPrefix(msg, "json: unknown field "), `"`)
+		return &FieldError{Field: field, Message: "unknown field"}
+	}
+	return NewAPIError(http.StatusBadRequest, CodeInvalidJSON, err.Error())
+}
+
+// requireFields is a FieldError for the first field (by name) that is blank
+func requireFields(fields map[string]string) error {
+	names := make([]string, 0, len(fields))
+	for name := range fields {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if strings.TrimSpace(fields[name]) == "" {
+			return &FieldError{Field: name, Message: "is required"}
+		}
+	}
+	return nil
+}
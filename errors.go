@@ -0,0 +1,164 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+
+	sh "github.com/murphysean/secrethitler"
+)
+
+// Error codes are stable, clients switch on them rather than the message
+const (
+	CodeBadRequest       = "bad_request"
+	CodeInvalidJSON      = "invalid_json"
+	CodeInvalidField     = "invalid_field"
+	CodeBodyTooLarge     = "body_too_large"
+	CodeUnsupportedMedia = "unsupported_media_type"
+	CodeUnauthorized     = "unauthorized"
+	CodeBadCredentials   = "bad_credentials"
+	CodeForbidden        = "forbidden"
+	CodeOriginNotAllowed = "origin_not_allowed"
+	CodeNotFound         = "not_found"
+	CodeMethodNotAllowed = "method_not_allowed"
+	CodeConflict         = "conflict"
+	CodePlayerExists     = "player_exists"
+	CodeEmailInUse       = "email_in_use"
+	CodePlayerInGame     = "player_in_game"
+	CodeRateLimited      = "rate_limited"
+	CodeLockedOut        = "locked_out"
+	CodeInternal         = "internal"
+
+	//The engine turned down an event
+	CodeInvalidEvent = "invalid_event"
+	CodeNotYourTurn  = "not_your_turn"
+	CodeTermLimited  = "term_limited"
+	CodeInvalidVote  = "invalid_vote"
+	CodeWrongState   = "wrong_state"
+	CodeNotInGame    = "not_in_game"
+	CodeGameFull     = "game_full"
+	CodeGameOver     = "game_over"
+)
+
+// APIError is the body of every error the api answers with
+type APIError struct {
+	Status    int                    `json:"-"`
+	Code      string                 `json:"code"`
+	Message   string                 `json:"message"`
+	Details   map[string]interface{} `json:"details,omitempty"`
+	EventType string                 `json:"eventType,omitempty"`
+	Field     string                 `json:"field,omitempty"`
+}
+
+func NewAPIError(status int, code, message string) *APIError {
+	return &APIError{Status: status, Code: code, Message: message}
+}
+
+func (ae *APIError) Error() string {
+	return ae.Message
+}
+
+// With adds a detail to the error
+func (ae *APIError) With(key string, value interface{}) *APIError {
+	if ae.Details == nil {
+		ae.Details = map[string]interface{}{}
+	}
+	ae.Details[key] = value
+	return ae
+}
+
+// MarshalJSON also writes the message as err, which clients from before
+// error codes read
+func (ae *APIError) MarshalJSON() ([]byte, error) {
+	type apiError APIError
+	return json.Marshal(struct {
+		*apiError
+		Err string `json:"err"`
+	}{(*apiError)(ae), ae.Message})
+}
+
+// toAPIError wraps errors that aren't APIErrors already, hiding the message
+// of anything unexpected
+func toAPIError(err error) *APIError {
+	switch e := err.(type) {
+	case *APIError:
+		return e
+	case *FieldError:
+		ae := NewAPIError(http.StatusBadRequest, CodeInvalidField, e.Error())
+		ae.Field = e.Field
+		return ae
+	}
+	switch err {
+	case errBodyTooLarge:
+		return NewAPIError(http.StatusRequestEntityTooLarge, CodeBodyTooLarge, "Request Entity Too Large")
+	case ErrNotFound:
+		return NewAPIError(http.StatusNotFound, CodeNotFound, "Not Found")
+	}
+	return NewAPIError(http.StatusInternalServerError, CodeInternal, "Internal Server Error")
+}
+
+// WriteError replies with the error as json
+func WriteError(w http.ResponseWriter, err error) {
+	ae := toAPIError(err)
+	if seconds, ok := ae.Details["retryAfter"].(int); ok {
+		w.Header().Set("Retry-After", strconv.Itoa(seconds))
+	}
+	b, _ := json.Marshal(ae)
+	w.Header().Del("Content-Length")
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(ae.Status)
+	w.Write(append(b, '\n'))
+}
+
+// engineMessages are the codes for what the engine says when it refuses an
+// event. Its errors are plain text, so the wording is all there is to go on.
+var engineMessages = []struct {
+	text string
+	code string
+}{
+	{"game is over", CodeGameOver},
+	{"game over", CodeGameOver},
+	{"game is full", CodeGameFull},
+	{"too many players", CodeGameFull},
+	{"not in game", CodeNotInGame},
+	{"not in the game", CodeNotInGame},
+	{"not your turn", CodeNotYourTurn},
+	{"not the president", CodeNotYourTurn},
+	{"not the chancellor", CodeNotYourTurn},
+	{"term limit", CodeTermLimited},
+	{"already voted", CodeInvalidVote},
+	{"invalid vote", CodeInvalidVote},
+	{"wrong state", CodeWrongState},
+	{"invalid state", CodeWrongState},
+}
+
+// engineCode reads which rule was broken from the engine's error. A finished
+// game refuses everything, otherwise an error it can't place is just invalid.
+func engineCode(err error, g sh.Game) string {
+	if gameOver(g) {
+		return CodeGameOver
+	}
+	msg := strings.ToLower(err.Error())
+	for _, m := range engineMessages {
+		if strings.Contains(msg, m.text) {
+			return m.code
+		}
+	}
+	return CodeInvalidEvent
+}
+
+// engineError turns an error from SubmitEvent into an APIError with a
+// stable code. It has to be called before anything else changes the game.
+func engineError(e sh.Event, game *sh.SecretHitler, err error) *APIError {
+	ae := NewAPIError(http.StatusBadRequest, CodeInvalidEvent, err.Error())
+	if e != nil {
+		ae.EventType = e.GetType()
+	}
+	if game != nil {
+		ae.Code = engineCode(err, game.Game)
+		ae.With("gameState", game.State)
+	}
+	return ae
+}
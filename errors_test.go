@@ -0,0 +1,47 @@
+package main
+
+import (
+	"errors"
+	"testing"
+
+	sh "github.com/murphysean/secrethitler"
+)
+
+func TestEngineError(t *testing.T) {
+	nominate := sh.GameEvent{BaseEvent: sh.BaseEvent{Type: sh.TypePlayerNominate}}
+	tests := []struct {
+		name     string
+		event    sh.Event
+		finished bool
+		err      string
+		code     string
+	}{
+		{"finished", nominate, true, "refused", CodeGameOver},
+		{"not your turn", nominate, false, "Not your turn", CodeNotYourTurn},
+		{"not the president", nominate, false, "player is not the president", CodeNotYourTurn},
+		{"term limited", nominate, false, "chancellor is term limited", CodeTermLimited},
+		{"voted", nominate, false, "player already voted", CodeInvalidVote},
+		{"full", nominate, false, "game is full", CodeGameFull},
+		{"stranger", nominate, false, "player not in game", CodeNotInGame},
+		{"wrong state", nominate, false, "invalid state for event", CodeWrongState},
+		{"unknown", nominate, false, "refused", CodeInvalidEvent},
+		{"no event", nil, false, "refused", CodeInvalidEvent},
+	}
+	for _, test := range tests {
+		shg := sh.NewSecretHitler()
+		shg.Game.State = sh.GameStateStarted
+		if test.finished {
+			shg.Game.State = sh.GameStateFinished
+		}
+		ae := engineError(test.event, shg, errors.New(test.err))
+		if ae.Code != test.code {
+			t.Errorf("%s: got %s, want %s", test.name, ae.Code, test.code)
+		}
+		if ae.Message != test.err {
+			t.Errorf("%s: message %q is not the engine's", test.name, ae.Message)
+		}
+		if test.event != nil && ae.EventType != test.event.GetType() {
+			t.Errorf("%s: event type %q", test.name, ae.EventType)
+		}
+	}
+}
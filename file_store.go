@@ -0,0 +1,290 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+type Writer struct {
+	Name string
+}
+
+type Reader struct {
+	Name string
+}
+
+func (w Writer) Write(b []byte) (int, error) {
+	f, err := os.OpenFile(w.Name, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0755)
+	if err != nil {
+		logger.Error("write event log", "file", w.Name, "err", err)
+		return 0, err
+	}
+	defer f.Close()
+
+	return f.Write(b)
+}
+
+func (r Reader) Read() string {
+	b, err := ioutil.ReadFile(r.Name) // just pass the file name
+	if err != nil {
+		logger.Error("read file", "file", r.Name, "err", err)
+	}
+	str := string(b) // convert content to a 'string'
+	return str       // print the content as a 'string'
+}
+
+// FileStore keeps each player and game log in its own json file
+type FileStore struct {
+	Dir string
+}
+
+func NewFileStore(dir string) (*FileStore, error) {
+	fs := &FileStore{Dir: dir}
+	if err := os.MkdirAll(fs.path("players"), os.ModePerm); err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(fs.path("games"), os.ModePerm); err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(fs.path("sessions"), 0700); err != nil {
+		return nil, err
+	}
+	return fs, nil
+}
+
+func (fs *FileStore) path(elem ...string) string {
+	return filepath.Join(append([]string{fs.Dir}, elem...)...)
+}
+
+func (fs *FileStore) GetPlayer(id string) (*Player, error) {
+	b, err := ioutil.ReadFile(fs.path("players", id+".json"))
+	if os.IsNotExist(err) {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	p := Player{}
+	err = json.Unmarshal(b, &p)
+	if err != nil {
+		return nil, err
+	}
+
+	return &p, nil
+}
+
+func (fs *FileStore) FindPlayerByEmail(email string) (*Player, error) {
+	files, err := filepath.Glob(fs.path("players", "*.json"))
+	if err != nil {
+		return nil, err
+	}
+	email = strings.TrimSpace(email)
+	for _, name := range files {
+		p, err := fs.GetPlayer(strings.TrimSuffix(filepath.Base(name), ".json"))
+		if err != nil {
+			continue
+		}
+		if strings.EqualFold(strings.TrimSpace(p.Email), email) {
+			return p, nil
+		}
+	}
+	return nil, ErrNotFound
+}
+
+func (fs *FileStore) PutPlayer(p *Player) error {
+	b, err := json.Marshal(p)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(fs.path("players", p.ID+".json"), b, os.ModePerm)
+}
+
+func (fs *FileStore) DeletePlayer(id string) error {
+	err := os.Remove(fs.path("players", id+".json"))
+	if os.IsNotExist(err) {
+		return ErrNotFound
+	}
+	return err
+}
+
+func (fs *FileStore) Sessions() ([]*Session, error) {
+	files, err := filepath.Glob(fs.path("sessions", "*.json"))
+	if err != nil {
+		return nil, err
+	}
+	ret := make([]*Session, 0, len(files))
+	for _, name := range files {
+		b, err := ioutil.ReadFile(name)
+		if err != nil {
+			return nil, err
+		}
+		s := Session{}
+		if err := json.Unmarshal(b, &s); err != nil {
+			return nil, err
+		}
+		ret = append(ret, &s)
+	}
+	return ret, nil
+}
+
+func (fs *FileStore) PutSession(s *Session) error {
+	b, err := json.Marshal(s)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(fs.path("sessions", s.ID+".json"), b, 0600)
+}
+
+func (fs *FileStore) DeleteSession(id string) error {
+	err := os.Remove(fs.path("sessions", id+".json"))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
+
+func (fs *FileStore) GetGameMeta(gameID string) (*GameMeta, error) {
+	b, err := ioutil.ReadFile(fs.path("games", gameID+".meta.json"))
+	if os.IsNotExist(err) {
+		return fs.legacyGameMeta(gameID)
+	}
+	if err != nil {
+		return nil, err
+	}
+	m := GameMeta{}
+	err = json.Unmarshal(b, &m)
+	if err != nil {
+		return nil, err
+	}
+
+	return &m, nil
+}
+
+// legacyGameMeta finds the name of games created before metadata records
+// existed, from the colon delimited games/names.json file
+func (fs *FileStore) legacyGameMeta(gameID string) (*GameMeta, error) {
+	namesFile := Reader{fs.path("games", "names.json")}.Read()
+
+	for _, line := range strings.Split(namesFile, "\r\n") {
+		pair := strings.SplitN(line, ":", 2)
+		if len(pair) == 2 && pair[0] == gameID {
+			return &GameMeta{ID: gameID, Name: pair[1], Visibility: VisibilityPublic}, nil
+		}
+	}
+	return nil, ErrNotFound
+}
+
+func (fs *FileStore) PutGameMeta(m *GameMeta) error {
+	b, err := json.Marshal(m)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(fs.path("games", m.ID+".meta.json"), b, os.ModePerm)
+}
+
+func (fs *FileStore) GameIDs() ([]string, error) {
+	logs, err := filepath.Glob(fs.path("games", "*.json"))
+	if err != nil {
+		return nil, err
+	}
+	ret := make([]string, 0, len(logs))
+	for _, name := range logs {
+		gameID := strings.TrimSuffix(filepath.Base(name), ".json")
+		if gameID == "names" || strings.HasSuffix(gameID, ".meta") {
+			continue
+		}
+		ret = append(ret, gameID)
+	}
+	return ret, nil
+}
+
+func (fs *FileStore) EventLog(gameID string) io.Writer {
+	return Writer{fs.path("games", gameID+".json")}
+}
+
+func (fs *FileStore) OpenEventLog(gameID string, offset int) (io.ReadCloser, error) {
+	f, err := os.Open(fs.path("games", gameID+".json"))
+	if os.IsNotExist(err) {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	br := bufio.NewReader(f)
+	for i := 0; i < offset; i++ {
+		if _, err := br.ReadBytes('\n'); err != nil {
+			break
+		}
+	}
+	return struct {
+		io.Reader
+		io.Closer
+	}{br, f}, nil
+}
+
+func (fs *FileStore) RewriteEventLog(gameID string, fn func(line []byte) []byte) error {
+	name := fs.path("games", gameID+".json")
+	b, err := ioutil.ReadFile(name)
+	if os.IsNotExist(err) {
+		return ErrNotFound
+	}
+	if err != nil {
+		return err
+	}
+	var buf bytes.Buffer
+	for _, line := range bytes.SplitAfter(b, []byte("\n")) {
+		buf.Write(fn(line))
+	}
+	if bytes.Equal(buf.Bytes(), b) {
+		return nil
+	}
+	//Write the new log next to the old one and swap it in
+	err = ioutil.WriteFile(name+".tmp", buf.Bytes(), 0755)
+	if err != nil {
+		return err
+	}
+	return os.Rename(name+".tmp", name)
+}
+
+func (fs *FileStore) Sync() error {
+	gameIDs, err := fs.GameIDs()
+	if err != nil {
+		return err
+	}
+	for _, gameID := range gameIDs {
+		f, err := os.OpenFile(fs.path("games", gameID+".json"), os.O_WRONLY|os.O_APPEND, 0755)
+		if err != nil {
+			return err
+		}
+		err = f.Sync()
+		f.Close()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (fs *FileStore) Ping() error {
+	for _, dir := range []string{"players", "games", "sessions"} {
+		f, err := ioutil.TempFile(fs.path(dir), ".ping")
+		if err != nil {
+			return err
+		}
+		f.Close()
+		if err := os.Remove(f.Name()); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (fs *FileStore) Close() error {
+	return nil
+}
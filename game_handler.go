@@ -3,205 +3,410 @@ package main
 import (
 	"context"
 	"encoding/json"
-	"fmt"
 	"io"
-	"io/ioutil"
 	"net/http"
-	"os"
-	"regexp"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/microcosm-cc/bluemonday"
 	sh "github.com/murphysean/secrethitler"
 )
 
-type Writer struct {
-	Name string
-}
+// LoadActiveGames replays every event log in the games directory and registers
+// the games that have not finished yet, so players can resume after a restart
+func (ah *APIHandler) LoadActiveGames() error {
+	gameIDs, err := ah.Store.GameIDs()
+	if err != nil {
+		return err
+	}
+	for _, gameID := range gameIDs {
+		g, err := ah.replayGameLog(gameID)
+		if err != nil {
+			ah.Log.Error("rehydrate game", "gameID", gameID, "err", err)
+			continue
+		}
+		if g.State == sh.GameStateFinished || g.WinningParty != "" {
+			continue
+		}
+		g.ID = gameID
 
-type Reader struct {
-	Name string
+		game := sh.NewSecretHitler()
+		game.Game = g
+		game.Log = ah.Metrics.TimeWrites(ah.Store.EventLog(gameID))
+		ah.gameMeta(gameID)
+		ah.m.Lock()
+		ah.ActiveGames[gameID] = game
+		ah.m.Unlock()
+	}
+	ah.m.Lock()
+	ah.rehydrated = true
+	ah.m.Unlock()
+	return nil
 }
 
-func (w Writer) Write(b []byte) (int, error) {
-	f, err := os.OpenFile(w.Name, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0755)
+// replayGameLog rebuilds the state of a game by applying its event log in order
+func (ah *APIHandler) replayGameLog(gameID string) (sh.Game, error) {
+	g := sh.Game{}
+	f, err := ah.Store.OpenEventLog(gameID, 0)
 	if err != nil {
-		fmt.Println("write:", w.Name, err)
-		return 0, err
+		return g, err
 	}
 	defer f.Close()
 
-	return f.Write(b)
+	c := make(chan sh.Event)
+	errc := make(chan error, 1)
+	go func() {
+		errc <- sh.ReadEventLog(f, c)
+	}()
+	for e := range c {
+		if err != nil {
+			//Keep draining so the reader can finish
+			continue
+		}
+		g, _, err = g.Apply(e)
+	}
+	if rerr := <-errc; rerr != nil && rerr != io.EOF {
+		return g, rerr
+	}
+	return g, err
 }
 
-func (r Reader) Read() string {
-	b, err := ioutil.ReadFile(r.Name) // just pass the file name
+// gameMeta returns the metadata of a game, loading it from the store the
+// first time it is asked for
+func (ah *APIHandler) gameMeta(gameID string) GameMeta {
+	ah.m.RLock()
+	m, ok := ah.Meta[gameID]
+	ah.m.RUnlock()
+	if ok {
+		return *m
+	}
+
+	m, err := ah.Store.GetGameMeta(gameID)
 	if err != nil {
-		fmt.Print(err)
+		return GameMeta{ID: gameID, Visibility: VisibilityPublic}
 	}
-	str := string(b) // convert content to a 'string'
-	return str       // print the content as a 'string'
+	ah.m.Lock()
+	ah.Meta[gameID] = m
+	ah.m.Unlock()
+	return *m
 }
 
-func generateName() string {
-	return ""
+// generateName comes up with a name that no active game is using
+func (ah *APIHandler) generateName() string {
+	ah.m.RLock()
+	defer ah.m.RUnlock()
+	return ah.Names.Generate(func(name string) bool {
+		for gameID := range ah.ActiveGames {
+			if m, ok := ah.Meta[gameID]; ok && m.Name == name {
+				return true
+			}
+		}
+		return false
+	})
 }
 
-func (ah APIHandler) CreateGameHandler(w http.ResponseWriter, r *http.Request) {
+func (ah *APIHandler) CreateGameHandler(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "application/json")
 	gameID := GenUUIDv4()
+	AddLogFields(r, "gameID", gameID)
 	game := sh.NewSecretHitler()
 	game.ID = gameID
-	game.Log = Writer{"games/" + gameID + ".json"}
-	name := r.URL.Query().Get("name")
-	if name == "" {
-		name = generateName()
-	}
-	// don't allow ":"" or "\r\n" in names
-	name = strings.Replace(name, ":", "", -1)
-	name = strings.Replace(name, "\r\n", "", -1)
-	Writer{"games/names.json"}.Write([]byte(game.ID + ":" + name + "\r\n"))
+	game.Log = ah.Metrics.TimeWrites(ah.Store.EventLog(gameID))
+
+	meta := GameMeta{
+		ID:         gameID,
+		Name:       r.URL.Query().Get("name"),
+		Visibility: r.URL.Query().Get("visibility"),
+	}
+	//The name, visibility and settings can also be posted up as json, and
+	//override the query only when they are in the body
+	hasBody, err := hasJSONBody(r)
+	if err != nil {
+		WriteError(w, err)
+		return
+	}
+	if hasBody {
+		body := struct {
+			Name       *string           `json:"name"`
+			Visibility *string           `json:"visibility"`
+			Settings   map[string]string `json:"settings"`
+		}{}
+		if err := decodeJSON(r, &body); err != nil {
+			WriteError(w, err)
+			return
+		}
+		if body.Name != nil {
+			meta.Name = *body.Name
+		}
+		if body.Visibility != nil {
+			meta.Visibility = *body.Visibility
+		}
+		if body.Settings != nil {
+			meta.Settings = body.Settings
+		}
+	}
+	meta.Name = strings.TrimSpace(meta.Name)
+	if len(meta.Name) > 64 {
+		WriteError(w, &FieldError{Field: "name", Message: "must be at most 64 characters"})
+		return
+	}
+	switch meta.Visibility {
+	case "":
+		meta.Visibility = VisibilityPublic
+	case VisibilityPublic, VisibilityPrivate:
+	default:
+		WriteError(w, &FieldError{Field: "visibility", Message: "must be public or private"})
+		return
+	}
+	if meta.Name == "" {
+		meta.Name = ah.generateName()
+	}
+	meta.ID = gameID
+	meta.CreatorID, _ = r.Context().Value("playerID").(string)
+	meta.CreatedAt = time.Now()
+	err = ah.Store.PutGameMeta(&meta)
+	if err != nil {
+		WriteError(w, err)
+		ah.logger(r).Error("store game meta", "err", err)
+		return
+	}
 	//Drop a game update event that sets the gameID
 	actx := context.Background()
 	actx = context.WithValue(actx, "playerID", "engine")
-	err := game.SubmitEvent(actx, sh.GameEvent{
+	//Held until the game is active, so its log is never seen without it
+	l := ah.gameLock(gameID)
+	l.Lock()
+	err = game.SubmitEvent(actx, sh.GameEvent{
 		BaseEvent: sh.BaseEvent{Type: sh.TypeGameUpdate},
 		Game:      game.Game,
 	})
 	if err != nil {
-		http.Error(w, JsonErrorString(err.Error()), http.StatusBadRequest)
-		fmt.Println(err)
+		l.Unlock()
+		WriteError(w, engineError(nil, game, err))
+		ah.logger(r).Error("create game", "err", err)
 		return
 	}
 
 	ah.m.Lock()
 	ah.ActiveGames[gameID] = game
+	ah.Meta[gameID] = &meta
 	ah.m.Unlock()
+	l.Unlock()
 
 	e := json.NewEncoder(w)
-	fg := GameFromGame(game.Game.Filter(r.Context()))
+	fg := GameFromGame(game.Game.Filter(r.Context()), meta)
 	e.Encode(&fg)
 }
 
-func (ah APIHandler) GetGamesHandler(w http.ResponseWriter, r *http.Request) {
+func (ah *APIHandler) GetGamesHandler(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "application/json")
 	type sg struct {
-		ID      string `json:"id"`
-		State   string `json:"state"`
-		Players int    `json:"players"`
-		Name    string `json:"name"`
-	}
+		ID         string    `json:"id"`
+		State      string    `json:"state"`
+		Players    int       `json:"players"`
+		Name       string    `json:"name"`
+		CreatorID  string    `json:"creatorId"`
+		CreatedAt  time.Time `json:"createdAt"`
+		Visibility string    `json:"visibility"`
+	}
+	playerID, _ := r.Context().Value("playerID").(string)
 	ret := make([]sg, 0)
-	ah.m.RLock()
-	for _, shg := range ah.ActiveGames {
-		game := GameFromGame(shg.Game)
+	for gameID, shg := range ah.activeGames() {
+		m := GameMeta{ID: gameID, Visibility: VisibilityPublic}
+		ah.m.RLock()
+		if am, ok := ah.Meta[gameID]; ok {
+			m = *am
+		}
+		ah.m.RUnlock()
+		//Private games are only listed for the player that created them
+		if m.Visibility == VisibilityPrivate && (playerID == "" || playerID != m.CreatorID) {
+			continue
+		}
+		g := ah.gameState(gameID, shg)
 		ret = append(ret, sg{
-			ID:      shg.Game.ID,
-			State:   shg.Game.State,
-			Players: len(shg.Game.Players),
-			Name:    game.Name,
+			ID:         gameID,
+			State:      g.State,
+			Players:    len(g.Players),
+			Name:       m.Name,
+			CreatorID:  m.CreatorID,
+			CreatedAt:  m.CreatedAt,
+			Visibility: m.Visibility,
 		})
 	}
-	ah.m.RUnlock()
 	e := json.NewEncoder(w)
 	e.Encode(&ret)
 }
 
-var gre = regexp.MustCompile(`^/api/games/([^/]+)/?.*$`)
-
-func (ah APIHandler) GetGameHandler(w http.ResponseWriter, r *http.Request) {
+func (ah *APIHandler) GetGameHandler(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "application/json")
-	rer := gre.FindStringSubmatch(r.URL.Path)
-	if len(rer) != 2 {
-		http.Error(w, JsonErrorString("No GameID found"), http.StatusBadRequest)
-		return
-	}
+	gameID := PathParam(r, "gameID")
+	AddLogFields(r, "gameID", gameID)
 	var g sh.Game
 	ah.m.RLock()
-	ret, ok := ah.ActiveGames[rer[1]]
+	ret, ok := ah.ActiveGames[gameID]
 	ah.m.RUnlock()
 
 	if !ok {
-		http.Error(w, JsonErrorString("Not Found"), http.StatusNotFound)
+		WriteError(w, NewAPIError(http.StatusNotFound, CodeNotFound, "Not Found"))
 		return
 	}
 
-	g = ret.Game
+	g = ah.gameState(gameID, ret)
 	e := json.NewEncoder(w)
 	//Filter it for the authenticated user
-	fg := GameFromGame(g.Filter(r.Context()))
+	fg := GameFromGame(g.Filter(r.Context()), ah.gameMeta(g.ID))
 	e.Encode(&fg)
 }
 
-func (ah APIHandler) UpdateGameHandler(w http.ResponseWriter, r *http.Request) {
-	if r.Context().Value("playerID").(string) != "admin" {
-		http.Error(w, JsonErrorString("Forbidden"), http.StatusForbidden)
-		return
-	}
-	rer := gre.FindStringSubmatch(r.URL.Path)
-	if len(rer) != 2 {
-		http.Error(w, JsonErrorString("No GameID found"), http.StatusBadRequest)
-		return
-	}
+// UpdateGameHandler overrides the game state, routes registers it with RoleAdmin
+func (ah *APIHandler) UpdateGameHandler(w http.ResponseWriter, r *http.Request) {
+	gameID := PathParam(r, "gameID")
+	AddLogFields(r, "gameID", gameID)
 	ah.m.RLock()
-	ret, ok := ah.ActiveGames[rer[1]]
+	ret, ok := ah.ActiveGames[gameID]
 	ah.m.RUnlock()
 	if !ok {
-		http.Error(w, JsonErrorString("Not Found"), http.StatusNotFound)
+		WriteError(w, NewAPIError(http.StatusNotFound, CodeNotFound, "Not Found"))
 		return
 	}
 
 	//Read in the game
 	g := sh.Game{}
-	d := json.NewDecoder(r.Body)
-	err := d.Decode(&g)
+	err := decodeJSON(r, &g)
 	if err != nil {
-		fmt.Println(err)
-		http.Error(w, JsonErrorString(err.Error()), http.StatusBadRequest)
+		ah.logger(r).Warn("decode game", "err", err)
+		WriteError(w, err)
 		return
 	}
-	g.ID = rer[1]
+	g.ID = gameID
+
+	//The engine knows administrators by the admin playerID
+	actx := context.WithValue(r.Context(), "playerID", "admin")
 
 	//Set it
-	err = ret.SubmitEvent(r.Context(), sh.GameEvent{
+	l := ah.gameLock(gameID)
+	l.Lock()
+	err = ret.SubmitEvent(actx, sh.GameEvent{
 		BaseEvent: sh.BaseEvent{Type: sh.TypeGameUpdate},
 		Game:      g,
 	})
+	l.Unlock()
+	if err != nil {
+		WriteError(w, engineError(nil, ret, err))
+		ah.logger(r).Warn("game update rejected", "err", err)
+		return
+	}
+	ah.logger(r).Info("game updated by admin", "state", g.State)
 
 	//Return the new game
 	e := json.NewEncoder(w)
-	//Filter it for the authenticated user
-	fg := GameFromGame(g.Filter(r.Context()))
+	fg := GameFromGame(g.Filter(actx), ah.gameMeta(g.ID))
 	e.Encode(&fg)
 }
 
-func (ah APIHandler) CreateGameEventHandler(w http.ResponseWriter, r *http.Request) {
-	rer := gre.FindStringSubmatch(r.URL.Path)
-	if len(rer) != 2 {
-		http.Error(w, JsonErrorString("No GameID found"), http.StatusBadRequest)
-		return
-	}
+func (ah *APIHandler) CreateGameEventHandler(w http.ResponseWriter, r *http.Request) {
+	gameID := PathParam(r, "gameID")
+	AddLogFields(r, "gameID", gameID)
 	ah.m.RLock()
-	ret, ok := ah.ActiveGames[rer[1]]
+	ret, ok := ah.ActiveGames[gameID]
 	ah.m.RUnlock()
 	if !ok {
-		http.Error(w, JsonErrorString("Not Found"), http.StatusNotFound)
+		WriteError(w, NewAPIError(http.StatusNotFound, CodeNotFound, "Not Found"))
 		return
 	}
 	//Read the whole body into a buffer (to be read twice)
-	b, err := ioutil.ReadAll(r.Body)
-	e, err := sh.UnmarshalEvent(b)
+	b, err := readBody(r)
 	if err != nil {
-		http.Error(w, JsonErrorString(err.Error()), http.StatusBadRequest)
-		fmt.Println(err)
+		WriteError(w, err)
 		return
 	}
-	if e == nil {
-		http.Error(w, JsonErrorString("Nil Event"), http.StatusBadRequest)
+	e, err := ah.submitEvent(r, ret, b)
+	if err != nil {
+		WriteError(w, err)
 		return
 	}
+
+	w.WriteHeader(http.StatusAccepted)
+	enc := json.NewEncoder(w)
+	enc.Encode(&e)
+}
+
+// gameLock is held around every SubmitEvent on the game, so while it is held
+// no event is part way through being applied, logged or sent to subscribers,
+// and the game and its log stay still
+func (ah *APIHandler) gameLock(gameID string) *sync.Mutex {
+	ah.m.Lock()
+	defer ah.m.Unlock()
+	l, ok := ah.gameLocks[gameID]
+	if !ok {
+		l = new(sync.Mutex)
+		ah.gameLocks[gameID] = l
+	}
+	return l
+}
+
+// gameOver is whether a game has finished, and so won't change any more
+func gameOver(g sh.Game) bool {
+	return g.State == sh.GameStateFinished || g.WinningParty != ""
+}
+
+func inGame(g sh.Game, playerID string) bool {
+	for _, p := range g.Players {
+		if p.ID == playerID {
+			return true
+		}
+	}
+	return false
+}
+
+// activeGames copies the map of active games, so each can be read under its
+// own lock without holding ah.m
+func (ah *APIHandler) activeGames() map[string]*sh.SecretHitler {
+	ah.m.RLock()
+	defer ah.m.RUnlock()
+	games := make(map[string]*sh.SecretHitler, len(ah.ActiveGames))
+	for gameID, shg := range ah.ActiveGames {
+		games[gameID] = shg
+	}
+	return games
+}
+
+// gameState copies the state of an active game while nothing is changing it
+func (ah *APIHandler) gameState(gameID string, ret *sh.SecretHitler) sh.Game {
+	l := ah.gameLock(gameID)
+	l.Lock()
+	defer l.Unlock()
+	return ret.Game
+}
+
+// submitEvent decodes, rate limits, sanitizes and submits an event from the
+// player of the request, whichever transport it came in on
+func (ah *APIHandler) submitEvent(r *http.Request, ret *sh.SecretHitler, b []byte) (sh.Event, error) {
+	e, err := sh.UnmarshalEvent(b)
+	if err != nil {
+		ah.logger(r).Warn("decode event", "err", err)
+		return nil, NewAPIError(http.StatusBadRequest, CodeInvalidEvent, err.Error())
+	}
+	if e == nil {
+		return nil, NewAPIError(http.StatusBadRequest, CodeInvalidEvent, "Nil Event")
+	}
+	//Game state is only overridden by admins, through UpdateGameHandler
+	if e.GetType() == sh.TypeGameUpdate {
+		ae := NewAPIError(http.StatusForbidden, CodeForbidden, "Forbidden")
+		ae.EventType = e.GetType()
+		return nil, ae
+	}
+	//Chatty events get their own budget per player, so spam can't lock up the game
+	limitKey, _ := r.Context().Value("playerID").(string)
+	if limitKey == "" {
+		limitKey = clientIP(r)
+	}
+	if ae := ah.checkLimit(r, eventLimit(e.GetType()), limitKey); ae != nil {
+		ae.EventType = e.GetType()
+		return nil, ae
+	}
 	//Sanitize input
 	switch e.GetType() {
 	case sh.TypePlayerMessage:
@@ -218,79 +423,77 @@ func (ah APIHandler) CreateGameEventHandler(w http.ResponseWriter, r *http.Reque
 		e = re
 	}
 	//Validate & submit the event against the game state
+	l := ah.gameLock(PathParam(r, "gameID"))
+	l.Lock()
+	//Checked under the game's lock, so a deletion that has checked the game
+	//can't have the player join it after
+	ah.m.RLock()
+	playerID, _ := r.Context().Value("playerID").(string)
+	deleting := ah.deleting[playerID]
+	ah.m.RUnlock()
+	if deleting {
+		l.Unlock()
+		return nil, NewAPIError(http.StatusForbidden, CodeForbidden, "Player is being deleted")
+	}
 	err = ret.SubmitEvent(r.Context(), e)
+	var ae *APIError
 	if err != nil {
-		http.Error(w, JsonErrorString(err.Error()), http.StatusBadRequest)
-		fmt.Println(err)
-		return
-	}
-
-	w.WriteHeader(http.StatusAccepted)
-	enc := json.NewEncoder(w)
-	enc.Encode(&e)
-}
-
-func shouldSendState(t string) bool {
-	if strings.HasPrefix(t, "request.") {
-		return false
-	}
-	if strings.HasPrefix(t, "react.") {
-		return false
-	}
-	if t == sh.TypeGameInformation {
-		return false
-	}
-	if t == sh.TypePlayerVote {
-		return false
-	}
-	if t == sh.TypePlayerMessage {
-		return false
+		//Judged against the game that refused it, before the next event
+		ae = engineError(e, ret, err)
 	}
-	if t == sh.TypeGuess {
-		return false
+	l.Unlock()
+	if err != nil {
+		ah.logger(r).Warn("event rejected", "eventType", e.GetType(), "code", ae.Code, "err", err)
+		ah.Metrics.EventsRejected.WithLabelValues(e.GetType(), ae.Code).Inc()
+		return nil, ae
 	}
-	return true
+	ah.Metrics.EventsSubmitted.WithLabelValues(e.GetType()).Inc()
+	ah.logger(r).Info("event accepted", "eventType", e.GetType())
+	return e, nil
 }
 
-func (ah APIHandler) GetGameEventsHandler(w http.ResponseWriter, r *http.Request) {
+func (ah *APIHandler) GetGameEventsHandler(w http.ResponseWriter, r *http.Request) {
 	// https://www.html5rocks.com/en/tutorials/eventsource/basics/
-	rer := gre.FindStringSubmatch(r.URL.Path)
-	if len(rer) != 2 {
-		http.Error(w, JsonErrorString("No GameID found"), http.StatusBadRequest)
-		return
-	}
+	gameID := PathParam(r, "gameID")
+	AddLogFields(r, "gameID", gameID)
 
 	//If the game isn't in the active games list, it still might be a log file...
 	ah.m.RLock()
-	ret, ok := ah.ActiveGames[rer[1]]
+	ret, ok := ah.ActiveGames[gameID]
 	ah.m.RUnlock()
 
 	leids := r.Header.Get("Last-Event-Id")
 	leid, _ := strconv.Atoi(leids)
 	//If the last event id is less than 0, or greater than a billion
-	if leid < 0 || leid >= 1000000000 {
-		w.Header().Set("Content-Type", "application/json")
-		http.Error(w, JsonErrorString("eof"), http.StatusTooManyRequests)
+	if leid < 0 || leid >= streamClosedID {
+		WriteError(w, NewAPIError(http.StatusTooManyRequests, CodeGameOver, "eof"))
+		return
+	}
+
+	opts, err := parseStreamOptions(r)
+	if err != nil {
+		WriteError(w, err)
 		return
 	}
 
 	if !ok {
-		//Ensure that the game doesn't already exist
-		if _, err := os.Stat("games/" + rer[1] + ".json"); err != nil {
-			w.Header().Set("Content-Type", "application/json")
-			http.Error(w, JsonErrorString("Not Found"), http.StatusNotFound)
+		//Ensure that the game at least has a log to replay
+		f, err := ah.Store.OpenEventLog(gameID, 0)
+		if err != nil {
+			WriteError(w, NewAPIError(http.StatusNotFound, CodeNotFound, "Not Found"))
 			return
 		}
+		f.Close()
 	}
 	//Is this a flushable connection
 	flusher, ok := w.(http.Flusher)
 	if !ok {
-		http.Error(w, "webserver doesn't support flushing", http.StatusInternalServerError)
+		WriteError(w, NewAPIError(http.StatusInternalServerError, CodeInternal, "webserver doesn't support flushing"))
 		return
 	}
 	cnot, ok := w.(http.CloseNotifier)
 	if !ok {
-		http.Error(w, "webserver doesn't support closenotify", http.StatusInternalServerError)
+		WriteError(w, NewAPIError(http.StatusInternalServerError, CodeInternal, "webserver doesn't support closenotify"))
 		return
 	}
 	cnotchan := cnot.CloseNotify()
@@ -298,193 +501,71 @@ func (ah APIHandler) GetGameEventsHandler(w http.ResponseWriter, r *http.Request
 	w.Header().Set("Content-Type", "text/event-stream")
 	w.Header().Set("Cache-Control", "no-cache")
 	w.WriteHeader(http.StatusOK)
-	fmt.Fprintf(w, ": Getting Started\n\n")
-	flusher.Flush()
-	var err error
-	if ret != nil {
-		for _, p := range ret.Game.Players {
-			var pb []byte
-			if p, err := GetPlayer(r.Context(), p.ID); err != nil {
-				p := new(Player)
-				p.ID = p.ID
-				p.Email = p.ID
-				p.Name = p.ID
-				p.Username = p.ID
-				p.ThumbnailURL = "http://www.gravatar.com/avatar"
-				pb, _ = json.Marshal(&p)
-			} else {
-				pb, _ = json.Marshal(&p)
-			}
-			fmt.Fprintf(w, "event: %s\n", "player")
-			fmt.Fprintf(w, "data: %s\n\n", pb)
-		}
-		flusher.Flush()
-	}
+	sw := sseWriter{w: w, f: flusher}
+	sw.Comment("Getting Started")
+	sw.Retry(opts.Retry)
+	sw.Flush()
 
-	myChan := make(chan sh.Event)
-	geid := 0
 	over := true
+	var g sh.Game
 	if ret != nil {
-		geid = ret.Game.EventID
-		if ret.Game.WinningParty == "" {
-			over = false
-		}
-
+		g = ah.gameState(gameID, ret)
+		over = g.WinningParty != ""
 	}
-	if geid == 0 || leid < geid {
-		//Stream events from the last event id specified
-		go func() {
-			f, err := os.OpenFile("games/"+rer[1]+".json", os.O_RDONLY, 0644)
-			if err != nil {
-				fmt.Println(err)
-				return
-			}
-			err = sh.ReadEventLog(f, myChan)
-			if err != nil && err != io.EOF {
-				fmt.Println(err)
-			}
-		}()
-		tg := sh.Game{}
-		for e := range myChan {
-			tg, _, err = tg.Apply(e)
-			if err != nil {
-				fmt.Println(err)
-			}
-			if leid > 0 && e.GetID() <= leid {
-				continue
-			}
-			//Don't filter if the real game is over
-			if !over {
-				//Before sending an event, filter it for the auth'd user
-				e = e.Filter(r.Context())
-			}
-			b, err := json.Marshal(&e)
-			if err != nil {
-				fmt.Println(err)
-			}
-			if e.GetType() == sh.TypePlayerJoin {
-				var pb []byte
-				pje := e.(sh.PlayerEvent)
-				if p, err := GetPlayer(r.Context(), pje.Player.ID); err != nil {
-					p := new(Player)
-					p.ID = pje.Player.ID
-					p.Email = pje.Player.ID
-					p.Name = pje.Player.ID
-					p.Username = pje.Player.ID
-					p.ThumbnailURL = "http://www.gravatar.com/avatar"
-					pb, _ = json.Marshal(&p)
-				} else {
-					pb, _ = json.Marshal(&p)
-				}
-				fmt.Fprintf(w, "id: %d\n", e.GetID())
-				fmt.Fprintf(w, "event: %s\n", "player")
-				fmt.Fprintf(w, "data: %s\n\n", pb)
-			}
-			fmt.Fprintf(w, "id: %d\n", e.GetID())
-			fmt.Fprintf(w, "event: %s\n", e.GetType())
-			fmt.Fprintf(w, "data: %s\n\n", b)
-			//Only send state on mutating events
-			if shouldSendState(e.GetType()) {
-				fmt.Fprintf(w, "id: %d\n", e.GetID())
-				fmt.Fprintf(w, "event: %s\n", "state")
-				g := GameFromGame(tg)
-				//Only filter if the real game is not over
-				if !over {
-					g = GameFromGame(tg.Filter(r.Context()))
-				}
-				b, err = json.Marshal(&g)
-				if err != nil {
-					fmt.Println(err)
-				}
-				fmt.Fprintf(w, "data: %s\n\n", b)
-				//Flush the data down the pipe
-			}
-			flusher.Flush()
+	//Don't filter if the real game is over
+	se := ah.newStreamEncoder(r, gameID, !over, sw)
+	se.state = opts.State
+	if ret != nil {
+		se.Players(g)
+	}
+	if ret == nil || over {
+		if err := se.Replay(leid, streamClosedID-1); err != nil {
+			ah.logger(r).Error("replay event log", "err", err)
 		}
 		//If the game is over, set last event id to a billion, return
-		if over {
-			fmt.Fprintf(w, "id: %d\n", 1000000000)
-			fmt.Fprintf(w, "event: %s\n", "server.close")
-			fmt.Fprintf(w, "data: %s\n\n", "{}")
-		}
-	}
-
-	if ret == nil {
-		flusher.Flush()
+		se.Close()
 		return
 	}
 
-	myChan = make(chan sh.Event)
+	//Subscribe before replaying, so events that land during the replay are
+	//queued rather than lost
+	sub := ah.Subscribe(gameID, ret, "sse")
+	defer sub.Close()
+	if err := se.Replay(leid, sub.Snapshot); err != nil {
+		ah.logger(r).Error("replay event log", "err", err)
+	}
 
-	//Subscribe to game events
-	uid := GenUUIDv4()
-	//Add this channel to the subscriber list for the game
-	ret.AddSubscriber(uid, myChan)
-
-	//Defer the removal of the chanel from the game on disconnect
-	defer func() {
-		ret.RemoveSubscriber(uid)
-	}()
+	//One ticker for the life of the stream, rather than a timer per event
+	keepalive := time.NewTicker(opts.Keepalive)
+	defer keepalive.Stop()
 
 	//Loop on events coming out of the gameserver
 	for {
 		select {
-		case e := <-myChan:
+		case e := <-sub.Events:
 			if e == nil {
-				flusher.Flush()
 				return
 			}
-			if e.GetType() == sh.TypePlayerJoin {
-				var pb []byte
-				pje := e.(sh.PlayerEvent)
-				if p, err := GetPlayer(r.Context(), pje.Player.ID); err != nil {
-					p := new(Player)
-					p.ID = pje.Player.ID
-					p.Email = pje.Player.ID
-					p.Name = pje.Player.ID
-					p.Username = pje.Player.ID
-					p.ThumbnailURL = "http://www.gravatar.com/avatar"
-					pb, _ = json.Marshal(&p)
-				} else {
-					pb, _ = json.Marshal(&p)
-				}
-				fmt.Fprintf(w, "id: %d\n", e.GetID())
-				fmt.Fprintf(w, "event: %s\n", "player")
-				fmt.Fprintf(w, "data: %s\n\n", pb)
-			}
-			//Before sending an event, filter it for the auth'd user
-			e = e.Filter(r.Context())
-			b, err := json.Marshal(&e)
-			if err != nil {
-				fmt.Println(err)
+			if err := se.Live(e); err != nil {
+				return
 			}
-			fmt.Fprintf(w, "id: %d\n", e.GetID())
-			fmt.Fprintf(w, "event: %s\n", e.GetType())
-			fmt.Fprintf(w, "data: %s\n\n", b)
-
-			if shouldSendState(e.GetType()) {
-				fmt.Fprintf(w, "id: %d\n", e.GetID())
-				//Optionally also include a seperate event sending the whole state for the client to sync on
-				fmt.Fprintf(w, "event: %s\n", "state")
-				//Before sending the state, filter it for the auth'd user
-				g := GameFromGame(ret.Game.Filter(r.Context()))
-				b, _ := json.Marshal(&g)
-				fmt.Fprintf(w, "data: %s\n\n", b)
+			if se.Finished() {
+				se.Close()
+				return
 			}
-		case <-time.After(time.Minute):
-			//Check the game state, if it is done, send the server close event
-			if ret != nil && ret.State == sh.GameStateFinished {
-				fmt.Fprintf(w, "id: %d\n", 1000000000)
-				fmt.Fprintf(w, "event: %s\n", "server.close")
-				fmt.Fprintf(w, "data: %s\n\n", "{}")
-			} else {
-				fmt.Fprintf(w, ": keepalive\n\n")
+		case <-keepalive.C:
+			sw.Comment("keepalive")
+			sw.Flush()
+		case n := <-sub.Resync:
+			ah.logger(r).Warn("stream fell behind", "dropped", n)
+			if err := se.Resync(ret, n); err != nil {
+				return
 			}
+		case <-ah.shutdown:
+			se.Restart()
+			return
 		case <-cnotchan:
-			flusher.Flush()
 			return
 		}
-		//Flush the data down the pipe
-		flusher.Flush()
 	}
 }
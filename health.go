@@ -0,0 +1,66 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"time"
+)
+
+// profilePinger is a profile provider that depends on an outside service
+type profilePinger interface {
+	Ping(ctx context.Context) error
+}
+
+// HealthzHandler answers as long as the process is serving requests
+func (ah *APIHandler) HealthzHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-cache")
+	json.NewEncoder(w).Encode(map[string]string{"status": "ok"})
+}
+
+// ReadyzHandler answers 200 only when the store can be written to and the
+// games have been loaded back in. Whether the profile provider can be reached
+// is reported alongside, but new players fall back to local profiles without
+// it, so it doesn't make the server unready.
+func (ah *APIHandler) ReadyzHandler(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := context.WithTimeout(r.Context(), 5*time.Second)
+	defer cancel()
+
+	checks := map[string]error{}
+	checks["store"] = ah.Store.Ping()
+	ah.m.RLock()
+	if !ah.rehydrated {
+		checks["games"] = errors.New("still loading games")
+	} else {
+		checks["games"] = nil
+	}
+	ah.m.RUnlock()
+
+	status := http.StatusOK
+	ret := struct {
+		Status string            `json:"status"`
+		Checks map[string]string `json:"checks"`
+		Info   map[string]string `json:"info"`
+	}{"ok", map[string]string{}, map[string]string{"profiles": "ok"}}
+	if pp, ok := ah.Profiles.(profilePinger); ok {
+		if err := pp.Ping(ctx); err != nil {
+			ah.Log.Info("profile provider unreachable, using local profiles", "err", err)
+			ret.Info["profiles"] = err.Error()
+		}
+	}
+	for name, err := range checks {
+		ret.Checks[name] = "ok"
+		if err != nil {
+			ah.Log.Warn("readiness check failed", "check", name, "err", err)
+			ret.Checks[name] = err.Error()
+			ret.Status = "unavailable"
+			status = http.StatusServiceUnavailable
+		}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(&ret)
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// patchOp is one operation of a JSON Patch (RFC 6902). Value is already
+// encoded so nulls, falses and zeros survive, and is left out of removes.
+type patchOp struct {
+	Op    string          `json:"op"`
+	Path  string          `json:"path"`
+	Value json.RawMessage `json:"value,omitempty"`
+}
+
+var pointerEscaper = strings.NewReplacer("~", "~0", "/", "~1")
+
+// jsonValue is v as the maps, slices and json.Numbers it encodes to, so two
+// documents can be compared field by field
+func jsonValue(v interface{}) (interface{}, error) {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	d := json.NewDecoder(bytes.NewReader(b))
+	d.UseNumber()
+	var jv interface{}
+	err = d.Decode(&jv)
+	return jv, err
+}
+
+// jsonDiff is the patch that turns the document from into to. Arrays that
+// change length are replaced whole rather than diffed item by item.
+func jsonDiff(from, to interface{}) []patchOp {
+	ops := []patchOp{}
+	diffValues(&ops, "", from, to)
+	return ops
+}
+
+func diffValues(ops *[]patchOp, path string, from, to interface{}) {
+	switch f := from.(type) {
+	case map[string]interface{}:
+		if t, ok := to.(map[string]interface{}); ok {
+			diffObjects(ops, path, f, t)
+			return
+		}
+	case []interface{}:
+		if t, ok := to.([]interface{}); ok && len(t) == len(f) {
+			for i := range f {
+				diffValues(ops, path+"/"+strconv.Itoa(i), f[i], t[i])
+			}
+			return
+		}
+	}
+	if !reflect.DeepEqual(from, to) {
+		*ops = append(*ops, patchValue("replace", path, to))
+	}
+}
+
+func diffObjects(ops *[]patchOp, path string, from, to map[string]interface{}) {
+	//Sorted, so the same change always makes the same patch
+	keys := make([]string, 0, len(from)+len(to))
+	for k := range from {
+		keys = append(keys, k)
+	}
+	for k := range to {
+		if _, ok := from[k]; !ok {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		p := path + "/" + pointerEscaper.Replace(k)
+		f, inFrom := from[k]
+		t, inTo := to[k]
+		switch {
+		case !inTo:
+			*ops = append(*ops, patchOp{Op: "remove", Path: p})
+		case !inFrom:
+			*ops = append(*ops, patchValue("add", p, t))
+		default:
+			diffValues(ops, p, f, t)
+		}
+	}
+}
+
+func patchValue(op, path string, v interface{}) patchOp {
+	b, _ := json.Marshal(v)
+	return patchOp{Op: op, Path: path, Value: b}
+}
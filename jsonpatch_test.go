@@ -0,0 +1,143 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// applyPatch applies the add, remove and replace operations jsonDiff makes,
+// so a patch can be checked by where it takes the document
+func applyPatch(doc interface{}, patch []patchOp) (interface{}, error) {
+	for _, op := range patch {
+		var value interface{}
+		if op.Op != "remove" {
+			v, err := jsonValue(op.Value)
+			if err != nil {
+				return nil, err
+			}
+			value = v
+		}
+		if op.Path == "" {
+			if op.Op == "remove" {
+				return nil, fmt.Errorf("remove of the whole document")
+			}
+			doc = value
+			continue
+		}
+		tokens := strings.Split(op.Path[1:], "/")
+		for i, tok := range tokens {
+			tokens[i] = strings.Replace(strings.Replace(tok, "~1", "/", -1), "~0", "~", -1)
+		}
+		parent := doc
+		for _, tok := range tokens[:len(tokens)-1] {
+			switch p := parent.(type) {
+			case map[string]interface{}:
+				parent = p[tok]
+			case []interface{}:
+				i, err := strconv.Atoi(tok)
+				if err != nil || i >= len(p) {
+					return nil, fmt.Errorf("%s: no index %s", op.Path, tok)
+				}
+				parent = p[i]
+			default:
+				return nil, fmt.Errorf("%s: %s isn't in a container", op.Path, tok)
+			}
+		}
+		key := tokens[len(tokens)-1]
+		switch p := parent.(type) {
+		case map[string]interface{}:
+			_, exists := p[key]
+			switch {
+			case op.Op == "add":
+				p[key] = value
+			case !exists:
+				return nil, fmt.Errorf("%s %s: no such key", op.Op, op.Path)
+			case op.Op == "remove":
+				delete(p, key)
+			default:
+				p[key] = value
+			}
+		case []interface{}:
+			i, err := strconv.Atoi(key)
+			if err != nil || i >= len(p) || op.Op != "replace" {
+				return nil, fmt.Errorf("%s %s: only replacing array items in place", op.Op, op.Path)
+			}
+			p[i] = value
+		default:
+			return nil, fmt.Errorf("%s: not in a container", op.Path)
+		}
+	}
+	return doc, nil
+}
+
+func TestJSONDiff(t *testing.T) {
+	tests := []struct {
+		name     string
+		from, to string
+		ops      []string
+	}{
+		{"same", `{"a":1,"b":[1,2]}`, `{"a":1,"b":[1,2]}`, nil},
+		{"add", `{"a":1}`, `{"a":1,"b":2}`, []string{"add /b"}},
+		{"remove", `{"a":1,"b":2}`, `{"a":1}`, []string{"remove /b"}},
+		{"replace", `{"a":1}`, `{"a":"one"}`, []string{"replace /a"}},
+		{"nested", `{"round":{"id":1,"votes":{"a":true}}}`, `{"round":{"id":2,"votes":{"a":true,"b":false}}}`,
+			[]string{"replace /round/id", "add /round/votes/b"}},
+		{"array item", `{"players":[{"id":"a","ready":false},{"id":"b","ready":false}]}`, `{"players":[{"id":"a","ready":false},{"id":"b","ready":true}]}`,
+			[]string{"replace /players/1/ready"}},
+		{"array grows", `{"players":["a"]}`, `{"players":["a","b"]}`, []string{"replace /players"}},
+		{"array shrinks", `{"players":["a","b"]}`, `{"players":["b"]}`, []string{"replace /players"}},
+		{"null to value", `{"draw":null}`, `{"draw":["liberal"]}`, []string{"replace /draw"}},
+		{"value to null", `{"draw":["liberal"]}`, `{"draw":null}`, []string{"replace /draw"}},
+		{"missing to null", `{}`, `{"draw":null}`, []string{"add /draw"}},
+		{"null to missing", `{"draw":null}`, `{}`, []string{"remove /draw"}},
+		{"false and zero kept", `{"ready":true,"n":1}`, `{"ready":false,"n":0}`, []string{"replace /n", "replace /ready"}},
+		{"escaped keys", `{"a/b":1,"c~d":1}`, `{"a/b":2,"c~d":2,"e~/f":3}`,
+			[]string{"replace /a~1b", "replace /c~0d", "add /e~0~1f"}},
+		{"type change", `{"a":{"b":1}}`, `{"a":[1]}`, []string{"replace /a"}},
+		{"whole document", `[1]`, `{"a":1}`, []string{"replace "}},
+	}
+	for _, test := range tests {
+		var from, to interface{}
+		if err := json.Unmarshal([]byte(test.from), &from); err != nil {
+			t.Fatal(err)
+		}
+		if err := json.Unmarshal([]byte(test.to), &to); err != nil {
+			t.Fatal(err)
+		}
+		from, _ = jsonValue(from)
+		to, _ = jsonValue(to)
+
+		patch := jsonDiff(from, to)
+		ops := []string{}
+		for _, op := range patch {
+			ops = append(ops, op.Op+" "+op.Path)
+		}
+		if len(ops) != len(test.ops) || (len(ops) > 0 && !reflect.DeepEqual(ops, test.ops)) {
+			t.Errorf("%s: got %v, want %v", test.name, ops, test.ops)
+		}
+
+		//The patch has to survive being sent, and take from to to
+		b, err := json.Marshal(patch)
+		if err != nil {
+			t.Fatal(err)
+		}
+		sent := []patchOp{}
+		if err := json.Unmarshal(b, &sent); err != nil {
+			t.Fatal(err)
+		}
+		//from is patched in place, so diff against a fresh copy
+		before, _ := jsonValue(from)
+		got, err := applyPatch(before, sent)
+		if err != nil {
+			t.Errorf("%s: %v", test.name, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, to) {
+			t.Errorf("%s: patched to %v, want %v", test.name, got, to)
+		}
+	}
+}
@@ -0,0 +1,234 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+)
+
+// Level is how severe a log line is
+type Level int
+
+const (
+	LevelDebug Level = iota
+	LevelInfo
+	LevelWarn
+	LevelError
+)
+
+var levelNames = map[Level]string{
+	LevelDebug: "debug",
+	LevelInfo:  "info",
+	LevelWarn:  "warn",
+	LevelError: "error",
+}
+
+func ParseLevel(s string) (Level, error) {
+	for l, name := range levelNames {
+		if name == s {
+			return l, nil
+		}
+	}
+	return LevelInfo, errors.New("unknown log level " + s)
+}
+
+// logger is for code that runs outside of a request, main replaces it once
+// the config is loaded
+var logger = NewLogger(os.Stderr, LevelInfo)
+
+// Logger writes one json object per line, carrying the fields it was made
+// With on every line
+type Logger struct {
+	out    io.Writer
+	m      *sync.Mutex
+	level  Level
+	fields []interface{}
+}
+
+func NewLogger(out io.Writer, level Level) *Logger {
+	return &Logger{out: out, m: new(sync.Mutex), level: level}
+}
+
+// With returns a logger that adds the key value pairs to every line
+func (l *Logger) With(kv ...interface{}) *Logger {
+	nl := *l
+	nl.fields = append(append([]interface{}{}, l.fields...), kv...)
+	return &nl
+}
+
+func (l *Logger) Debug(msg string, kv ...interface{}) { l.log(LevelDebug, msg, kv) }
+func (l *Logger) Info(msg string, kv ...interface{})  { l.log(LevelInfo, msg, kv) }
+func (l *Logger) Warn(msg string, kv ...interface{})  { l.log(LevelWarn, msg, kv) }
+func (l *Logger) Error(msg string, kv ...interface{}) { l.log(LevelError, msg, kv) }
+
+func (l *Logger) log(level Level, msg string, kv []interface{}) {
+	if level < l.level {
+		return
+	}
+	line := map[string]interface{}{
+		"time":  time.Now().UTC().Format(time.RFC3339Nano),
+		"level": levelNames[level],
+		"msg":   msg,
+	}
+	fields := append(append([]interface{}{}, l.fields...), kv...)
+	for i := 0; i+1 < len(fields); i += 2 {
+		k, _ := fields[i].(string)
+		v := fields[i+1]
+		//Errors marshal to {} otherwise
+		if err, ok := v.(error); ok {
+			v = err.Error()
+		}
+		line[k] = v
+	}
+	b, err := json.Marshal(line)
+	if err != nil {
+		b, _ = json.Marshal(map[string]string{"level": "error", "msg": "unloggable line: " + err.Error()})
+	}
+	l.m.Lock()
+	l.out.Write(append(b, '\n'))
+	l.m.Unlock()
+}
+
+type logKey struct{}
+
+// requestLog is shared by everything handling a request so fields added
+// deeper in, like the player or game, also end up on the access log line
+type requestLog struct {
+	m      sync.Mutex
+	logger *Logger
+	//route is the pattern the router matched
+	route string
+}
+
+// AddLogFields adds key value pairs to the rest of the log lines of the request
+func AddLogFields(r *http.Request, kv ...interface{}) {
+	if rl, ok := r.Context().Value(logKey{}).(*requestLog); ok {
+		rl.m.Lock()
+		rl.logger = rl.logger.With(kv...)
+		rl.m.Unlock()
+	}
+}
+
+// setRoute records the route pattern the request matched
+func setRoute(r *http.Request, pattern string) {
+	if rl, ok := r.Context().Value(logKey{}).(*requestLog); ok {
+		rl.m.Lock()
+		rl.route = pattern
+		rl.m.Unlock()
+	}
+}
+
+// logger is the logger for the request, with its request id and any fields
+// added so far
+func (ah *APIHandler) logger(r *http.Request) *Logger {
+	if rl, ok := r.Context().Value(logKey{}).(*requestLog); ok {
+		rl.m.Lock()
+		defer rl.m.Unlock()
+		return rl.logger
+	}
+	return ah.Log
+}
+
+// statusRecorder remembers the status and size of a response for the access log
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+	size   int
+}
+
+func (sr *statusRecorder) WriteHeader(status int) {
+	if sr.status == 0 {
+		sr.status = status
+	}
+	sr.ResponseWriter.WriteHeader(status)
+}
+
+func (sr *statusRecorder) Write(b []byte) (int, error) {
+	if sr.status == 0 {
+		sr.status = http.StatusOK
+	}
+	n, err := sr.ResponseWriter.Write(b)
+	sr.size += n
+	return n, err
+}
+
+// The event stream needs these from the underlying writer
+func (sr *statusRecorder) Flush() {
+	if f, ok := sr.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+func (sr *statusRecorder) CloseNotify() <-chan bool {
+	if cn, ok := sr.ResponseWriter.(http.CloseNotifier); ok {
+		return cn.CloseNotify()
+	}
+	return make(chan bool)
+}
+
+func (sr *statusRecorder) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	if h, ok := sr.ResponseWriter.(http.Hijacker); ok {
+		return h.Hijack()
+	}
+	return nil, nil, errors.New("response can't be hijacked")
+}
+
+// validRequestID keeps ids from proxies short and printable
+func validRequestID(id string) bool {
+	if id == "" || len(id) > 64 {
+		return false
+	}
+	for _, c := range id {
+		if c <= ' ' || c > '~' {
+			return false
+		}
+	}
+	return true
+}
+
+// accessLog gives every request an id, returned in the X-Request-Id header
+// (or taken from it when a proxy set one), and logs it once it is done
+func (ah *APIHandler) accessLog(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		requestID := r.Header.Get("X-Request-Id")
+		if !validRequestID(requestID) {
+			requestID = GenUUIDv4()
+		}
+		w.Header().Set("X-Request-Id", requestID)
+		rl := &requestLog{logger: ah.Log.With("requestId", requestID)}
+		ctx := context.WithValue(r.Context(), logKey{}, rl)
+		sr := &statusRecorder{ResponseWriter: w}
+		next.ServeHTTP(sr, r.WithContext(ctx))
+		if sr.status == 0 {
+			sr.status = http.StatusOK
+		}
+
+		rl.m.Lock()
+		l, route := rl.logger, rl.route
+		rl.m.Unlock()
+		d := time.Since(start)
+		ah.Metrics.ObserveRequest(route, r.Method, sr.status, d)
+		level := l.Info
+		if sr.status >= 500 {
+			level = l.Error
+		}
+		level("request",
+			"method", r.Method,
+			"path", r.URL.Path,
+			"route", route,
+			"status", sr.status,
+			"bytes", sr.size,
+			"durationMs", float64(d)/float64(time.Millisecond),
+			"remoteAddr", r.RemoteAddr,
+			"userAgent", r.UserAgent(),
+		)
+	})
+}
@@ -1,51 +1,56 @@
 package main
 
 import (
-	"crypto/hmac"
-	"crypto/sha256"
-	"encoding/base64"
 	"encoding/json"
 	"net/http"
 )
 
-func (ah APIHandler) LoginHandler(w http.ResponseWriter, r *http.Request) {
+func (ah *APIHandler) LoginHandler(w http.ResponseWriter, r *http.Request) {
 	switch r.Header.Get("Content-Type") {
 	case "application/json":
 		creds := struct {
 			Username string `json:"username"`
 			Password string `json:"password"`
 		}{}
-		d := json.NewDecoder(r.Body)
-		err := d.Decode(&creds)
+		err := decodeJSON(r, &creds)
+		if err == nil {
+			err = requireFields(map[string]string{"username": creds.Username, "password": creds.Password})
+		}
 		if err != nil {
-			http.Error(w, JsonErrorString("Bad Request"), http.StatusBadRequest)
+			WriteError(w, err)
 			return
 		}
-		if creds.Username == "" || creds.Password == "" {
-			http.Error(w, JsonErrorString("Bad Request"), http.StatusBadRequest)
+		if d := ah.Lockout.Locked(creds.Username); d > 0 {
+			WriteError(w, tooManyRequests(d, CodeLockedOut, "Too many failed logins, try again later"))
 			return
 		}
-		g, err := GetGravatar(creds.Username)
+		p, err := ah.Store.FindPlayerByEmail(creds.Username)
 		if err != nil {
-			http.Error(w, JsonErrorString("Unauthorized"), http.StatusUnauthorized)
+			ah.Lockout.Fail(creds.Username)
+			WriteError(w, NewAPIError(http.StatusUnauthorized, CodeBadCredentials, "Unauthorized"))
 			return
 		}
-		p, err := GetPlayer(r.Context(), g.ID)
-		if err != nil {
-			http.Error(w, JsonErrorString("Unauthorized"), http.StatusUnauthorized)
+		ok, rehash := checkPassword(p.Email, creds.Password, p.PasswordHash)
+		if !ok {
+			ah.Lockout.Fail(creds.Username)
+			WriteError(w, NewAPIError(http.StatusUnauthorized, CodeBadCredentials, "Unauthorized"))
 			return
 		}
-		if !passwordHashmatches(creds.Username, creds.Password, p.PasswordHash) {
-			http.Error(w, JsonErrorString("Unauthorized"), http.StatusUnauthorized)
+		ah.Lockout.Succeed(creds.Username)
+		if rehash {
+			ah.rehashPassword(p, creds.Password)
+		}
+		p.PasswordHash = ""
+		token, _, err := ah.Sessions.Create(p.ID, p.GetRole(), r)
+		if err != nil {
+			WriteError(w, err)
 			return
 		}
-		sessionID := GenUUIDv4()
-		ah.Sessions[sessionID] = p
 		ret := struct {
 			Token  string  `json:"token"`
 			Player *Player `json:"player"`
 		}{
-			Token:  sessionID,
+			Token:  token,
 			Player: p,
 		}
 		e := json.NewEncoder(w)
@@ -53,50 +58,92 @@ func (ah APIHandler) LoginHandler(w http.ResponseWriter, r *http.Request) {
 	case "application/x-www-form-urlencoded":
 		username := r.PostFormValue("username")
 		password := r.PostFormValue("password")
-		if username == "" || password == "" {
-			http.Error(w, "Bad Request", http.StatusBadRequest)
+		if err := requireFields(map[string]string{"username": username, "password": password}); err != nil {
+			WriteError(w, err)
 			return
 		}
-		g, err := GetGravatar(username)
-		if err != nil {
-			http.Error(w, "Unauthorized"+err.Error(), http.StatusUnauthorized)
+		if d := ah.Lockout.Locked(username); d > 0 {
+			WriteError(w, tooManyRequests(d, CodeLockedOut, "Too many failed logins, try again later"))
 			return
 		}
-		p, err := GetPlayer(r.Context(), g.ID)
+		p, err := ah.Store.FindPlayerByEmail(username)
 		if err != nil {
-			http.Error(w, "Unauthorized"+err.Error(), http.StatusUnauthorized)
+			ah.Lockout.Fail(username)
+			WriteError(w, NewAPIError(http.StatusUnauthorized, CodeBadCredentials, "Unauthorized"))
 			return
 		}
-		if !passwordHashmatches(username, password, p.PasswordHash) {
-			http.Error(w, "Unauthorized"+" password doesn't match", http.StatusUnauthorized)
+		ok, rehash := checkPassword(p.Email, password, p.PasswordHash)
+		if !ok {
+			ah.Lockout.Fail(username)
+			WriteError(w, NewAPIError(http.StatusUnauthorized, CodeBadCredentials, "Unauthorized"))
 			return
 		}
-		sessionID := GenUUIDv4()
-		ah.Sessions[sessionID] = p
-		//TODO Set secure?
-		c := http.Cookie{
-			HttpOnly: true,
-			Name:     "shsid",
-			Value:    sessionID,
-			Path:     "/",
+		ah.Lockout.Succeed(username)
+		if rehash {
+			ah.rehashPassword(p, password)
 		}
-		http.SetCookie(w, &c)
+		token, _, err := ah.Sessions.Create(p.ID, p.GetRole(), r)
+		if err != nil {
+			WriteError(w, NewAPIError(http.StatusInternalServerError, CodeInternal, "Internal Server Error"))
+			return
+		}
+		http.SetCookie(w, ah.sessionCookie(token, 0))
 		//Redirect to index page
 		http.Redirect(w, r, "/", http.StatusTemporaryRedirect)
 	default:
-		http.Error(w, "Unsupported Media Type", http.StatusUnsupportedMediaType)
+		WriteError(w, NewAPIError(http.StatusUnsupportedMediaType, CodeUnsupportedMedia, "Unsupported Media Type"))
 		return
 	}
 }
 
-func passwordHashmatches(username, password, hash string) bool {
-	sig := hmac.New(sha256.New, []byte(username))
-	sig.Write([]byte(password))
-	passwordHash := base64.URLEncoding.EncodeToString(sig.Sum(nil))
+func (ah *APIHandler) LogoutHandler(w http.ResponseWriter, r *http.Request) {
+	if h := r.Header.Get("Authorization"); h != "" && len(h) > 7 {
+		ah.Sessions.Delete(h[7:])
+	}
+	if c, err := r.Cookie("shsid"); err == nil {
+		ah.Sessions.Delete(c.Value)
+	}
+	//Expire the cookie on the client as well
+	http.SetCookie(w, ah.sessionCookie("", -1))
+	if r.Header.Get("Content-Type") == "application/x-www-form-urlencoded" {
+		http.Redirect(w, r, "/", http.StatusSeeOther)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
 
-	if passwordHash == hash {
-		return true
+// rehashPassword replaces an outdated password hash now that we know the
+// password, failing quietly so the login still goes through
+func (ah *APIHandler) rehashPassword(p *Player, password string) {
+	hash, err := hashPassword(password)
+	if err != nil {
+		ah.Log.Error("rehash password", "playerID", p.ID, "err", err)
+		return
 	}
+	p.PasswordHash = hash
+	if err := ah.Store.PutPlayer(p); err != nil {
+		ah.Log.Error("rehash password", "playerID", p.ID, "err", err)
+	}
+}
 
-	return false
+// sessionCookie holds the session token, only sent over https when the server
+// has tls. Credentialed cross-origin clients need it sent cross-site, which
+// browsers only do for secure cookies.
+func (ah *APIHandler) sessionCookie(token string, maxAge int) *http.Cookie {
+	c := &http.Cookie{
+		HttpOnly: true,
+		Name:     "shsid",
+		Value:    token,
+		Path:     "/",
+		MaxAge:   maxAge,
+	}
+	switch {
+	case ah.Config.CORSCredentials:
+		c.Secure = true
+		c.SameSite = http.SameSiteNoneMode
+	case ah.Config.TLSCert != "":
+		c.Secure = true
+		c.SameSite = http.SameSiteLaxMode
+	}
+	return c
 }
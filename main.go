@@ -3,122 +3,243 @@ package main
 import (
 	"context"
 	"crypto/rand"
-	"encoding/json"
+	"flag"
 	"fmt"
+	"log"
 	"net/http"
 	"os"
-	"strings"
+	"os/signal"
 	"sync"
+	"syscall"
+	"time"
 
 	sh "github.com/murphysean/secrethitler"
 )
 
-var testingMode = false
-
 func main() {
-	//Specify a file to write all the events to
+	cfg, err := LoadConfig(os.Args[1:])
+	if err == flag.ErrHelp {
+		return
+	}
+	if err != nil {
+		log.Fatalln(err)
+	}
+	level, _ := ParseLevel(cfg.LogLevel)
+	logger = NewLogger(os.Stderr, level)
+
+	store, err := OpenStore(cfg.Store, cfg.DataDir)
+	if err != nil {
+		log.Fatalf("error opening store: %v\n", err)
+	}
+	defer store.Close()
+
+	if cfg.PromoteAdmin != "" {
+		if err := PromotePlayer(store, cfg.PromoteAdmin); err != nil {
+			log.Fatalf("error promoting admin: %v\n", err)
+		}
+		fmt.Println("promoted", cfg.PromoteAdmin, "to admin")
+		return
+	}
+
+	if cfg.NameSeed == 0 {
+		cfg.NameSeed = time.Now().UnixNano()
+	}
+	names, err := NewNameGenerator(cfg.NameTheme, cfg.NameSeed)
+	if err != nil {
+		log.Fatalf("error creating name generator: %v\n", err)
+	}
 
-	os.MkdirAll("players", os.ModePerm)
-	os.MkdirAll("games", os.ModePerm)
+	var sessionStore Store
+	if cfg.PersistSessions {
+		sessionStore = store
+	}
+	sessions, err := NewSessionStore(cfg.SessionTTL, sessionStore)
+	if err != nil {
+		log.Fatalf("error loading sessions: %v\n", err)
+	}
+	go func() {
+		for range time.Tick(time.Minute) {
+			sessions.Prune()
+		}
+	}()
 
-	apiHandler := NewAPIHandler()
+	profiles, err := NewProfileProvider(cfg.Profiles, cfg.GravatarTimeout)
+	if err != nil {
+		log.Fatalf("error creating profile provider: %v\n", err)
+	}
 
-	http.HandleFunc("/api/login", apiHandler.LoginHandler)
+	apiHandler := NewAPIHandler(cfg, store, names, sessions, profiles)
+	go func() {
+		for range time.Tick(time.Minute) {
+			apiHandler.Limiter.Prune()
+			apiHandler.Lockout.Prune()
+		}
+	}()
+	//Pick back up any games that were in progress when the server went down
+	if err := apiHandler.LoadActiveGames(); err != nil {
+		logger.Error("rehydrate games", "err", err)
+	}
+
+	http.HandleFunc("/avatars/", AvatarHandler)
 	http.Handle("/api/", apiHandler)
+	http.Handle("/metrics", apiHandler.Metrics.Handler())
+	http.HandleFunc("/healthz", apiHandler.HealthzHandler)
+	http.HandleFunc("/readyz", apiHandler.ReadyzHandler)
 
 	//A file handler for the static assets
-	http.Handle("/", http.FileServer(http.Dir("www")))
+	http.Handle("/", http.FileServer(http.Dir(cfg.StaticDir)))
+
+	server := &http.Server{Addr: cfg.Listen}
+	//Streams are told to reconnect as soon as shutdown starts, they would hold it up otherwise
+	server.RegisterOnShutdown(apiHandler.Shutdown)
+	//Made before the signal handler starts, which shuts it down too
+	var redirect *http.Server
+	if cfg.RedirectHTTP != "" {
+		redirect = &http.Server{Addr: cfg.RedirectHTTP, Handler: RedirectHandler(cfg.Listen)}
+	}
+	stopped := make(chan struct{})
+	go func() {
+		sigs := make(chan os.Signal, 1)
+		signal.Notify(sigs, os.Interrupt, syscall.SIGTERM)
+		<-sigs
+		logger.Info("shutting down")
+		ctx, cancel := context.WithTimeout(context.Background(), cfg.ShutdownTimeout)
+		defer cancel()
+		if redirect != nil {
+			redirect.Shutdown(ctx)
+		}
+		if err := server.Shutdown(ctx); err != nil {
+			logger.Error("shutdown", "err", err)
+		}
+		close(stopped)
+	}()
+
+	logger.Info("listening", "addr", cfg.Listen, "tls", cfg.TLSCert != "")
+	if cfg.TLSCert != "" {
+		var certs *CertReloader
+		certs, err = NewCertReloader(cfg.TLSCert, cfg.TLSKey)
+		if err != nil {
+			log.Fatalf("error loading certificate: %v\n", err)
+		}
+		go certs.Watch(certPollInterval, stopped)
+		server.TLSConfig = certs.TLSConfig()
 
-	http.ListenAndServe(":8080", nil)
+		if redirect != nil {
+			go func() {
+				if err := redirect.ListenAndServe(); err != http.ErrServerClosed {
+					log.Fatalln(err)
+				}
+			}()
+		}
+		//The certificate comes from the TLSConfig
+		err = server.ListenAndServeTLS("", "")
+	} else {
+		err = server.ListenAndServe()
+	}
+	if err != http.ErrServerClosed {
+		log.Fatalln(err)
+	}
+	<-stopped
+
+	if err := store.Sync(); err != nil {
+		logger.Error("sync store", "err", err)
+	}
 }
 
 type APIHandler struct {
-	Sessions    map[string]*Player
+	Config      *Config
+	Log         *Logger
+	Metrics     *Metrics
+	Limiter     *RateLimiter
+	Lockout     *LoginLockout
+	Store       Store
+	Names       *NameGenerator
+	Sessions    *SessionStore
+	Profiles    ProfileProvider
 	ActiveGames map[string]*sh.SecretHitler
-	m           sync.RWMutex
+	Meta        map[string]*GameMeta
+	//gameLocks are held by everything that changes a game, see gameLock
+	gameLocks map[string]*sync.Mutex
+	//deleting are the players being deleted, who can't submit events
+	deleting map[string]bool
+	router   *Router
+	m        sync.RWMutex
+	//rehydrated is set once LoadActiveGames is done
+	rehydrated bool
+
+	//shutdown is closed once the server starts stopping
+	shutdown     chan struct{}
+	shutdownOnce sync.Once
 }
 
-func NewAPIHandler() *APIHandler {
+func NewAPIHandler(cfg *Config, store Store, names *NameGenerator, sessions *SessionStore, profiles ProfileProvider) *APIHandler {
 	ret := new(APIHandler)
+	ret.Config = cfg
+	ret.Log = logger
+	ret.Store = store
+	ret.Names = names
+	ret.Sessions = sessions
+	ret.Profiles = profiles
 	ret.ActiveGames = make(map[string]*sh.SecretHitler)
-	ret.Sessions = make(map[string]*Player)
+	ret.Meta = make(map[string]*GameMeta)
+	ret.gameLocks = make(map[string]*sync.Mutex)
+	ret.deleting = make(map[string]bool)
+	ret.Limiter = NewRateLimiter(rateLimits)
+	ret.Lockout = NewLoginLockout(cfg.LoginMaxFailures, cfg.LoginLockout)
+	ret.Metrics = NewMetrics(ret)
+	ret.router = ret.routes()
+	ret.shutdown = make(chan struct{})
 	return ret
 }
 
+// Shutdown sends every event stream subscriber away to reconnect after the restart
+func (ah *APIHandler) Shutdown() {
+	ah.shutdownOnce.Do(func() {
+		close(ah.shutdown)
+	})
+}
+
+// routes is every endpoint under /api/
+func (ah *APIHandler) routes() *Router {
+	rr := new(Router)
+	rr.Use(ah.cors, ah.accessLog, ah.Authenticate, apiHeaders)
+
+	rr.Handle(http.MethodPost, "/api/login", "", ah.limitByIP("login", limitBody(maxSmallBody, ah.LoginHandler)))
+	rr.Handle(http.MethodPost, "/api/logout", "", ah.LogoutHandler)
+
+	rr.Handle(http.MethodPost, "/api/players", "", ah.limitByIP("register", limitBody(maxSmallBody, ah.CreatePlayerHandler)))
+	rr.Handle(http.MethodGet, "/api/players/{playerID}", "", ah.GetPlayerHandler)
+	rr.Handle(http.MethodPut, "/api/players/{playerID}", RolePlayer, limitBody(maxSmallBody, ah.UpdatePlayerHandler))
+	rr.Handle(http.MethodPatch, "/api/players/{playerID}", RolePlayer, limitBody(maxSmallBody, ah.UpdatePlayerHandler))
+	rr.Handle(http.MethodDelete, "/api/players/{playerID}", RolePlayer, ah.DeletePlayerHandler)
+	rr.Handle(http.MethodPost, "/api/players/{playerID}/password", RolePlayer, limitBody(maxSmallBody, ah.ChangePasswordHandler))
+
+	rr.Handle(http.MethodGet, "/api/sessions", RolePlayer, ah.GetSessionsHandler)
+	rr.Handle(http.MethodDelete, "/api/sessions/{sessionID}", RolePlayer, ah.DeleteSessionHandler)
+
+	rr.Handle(http.MethodGet, "/api/games", "", ah.GetGamesHandler)
+	rr.Handle(http.MethodPost, "/api/games", "", limitBody(maxSmallBody, ah.CreateGameHandler))
+	rr.Handle(http.MethodGet, "/api/games/{gameID}", "", ah.GetGameHandler)
+	//Overriding the game state
+	rr.Handle(http.MethodPut, "/api/games/{gameID}", RoleAdmin, limitBody(maxGameBody, ah.UpdateGameHandler))
+	//The event stream, and players putting up their events
+	rr.Handle(http.MethodGet, "/api/games/{gameID}/events", "", ah.GetGameEventsHandler)
+	rr.Handle(http.MethodPost, "/api/games/{gameID}/events", "", limitBody(maxSmallBody, ah.CreateGameEventHandler))
+	//Or both ways over one websocket
+	rr.Handle(http.MethodGet, "/api/games/{gameID}/ws", "", ah.GameSocketHandler)
+	return rr
+}
+
 func (ah *APIHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
-	//Set this with the authenticated users playerID
-	ctx := r.Context()
-	playerID := ""
-	if h := r.Header.Get("Authorization"); h != "" && len(h) > 7 {
-		token := h[7:]
-		if ah.Sessions[token] != nil {
-			playerID = ah.Sessions[token].ID
-		}
-	}
-	if c, err := r.Cookie("shsid"); err == nil && playerID == "" {
-		if ah.Sessions[c.Value] != nil {
-			playerID = ah.Sessions[c.Value].ID
-		}
-	}
-	if testingMode && playerID == "" {
-		playerID = r.URL.Query().Get("playerID")
-	}
-	ctx = context.WithValue(r.Context(), "playerID", playerID)
-
-	w.Header().Set("Content-Type", "application/json")
-	w.Header().Set("Access-Control-Allow-Origin", "*")
-	w.Header().Set("Access-Control-Expose-Headers", "*")
-	switch {
-	case strings.HasPrefix(r.URL.Path, "/api/players"):
-		if len(r.URL.Path) <= 13 {
-			switch r.Method {
-			case http.MethodPost:
-				ah.CreatePlayerHandler(w, r.WithContext(ctx))
-			default:
-				http.Error(w, JsonErrorString("Method Not Allowed"), http.StatusMethodNotAllowed)
-			}
-
-		} else {
-			//GET  /api/players/{playerID}
-			ah.GetPlayerHandler(w, r.WithContext(ctx))
-		}
-	case strings.HasPrefix(r.URL.Path, "/api/games"):
-		if len(r.URL.Path) <= 11 {
-			//GET  /api/games
-			//POST /api/games
-			switch r.Method {
-			case http.MethodGet:
-				ah.GetGamesHandler(w, r.WithContext(ctx))
-			case http.MethodPost:
-				ah.CreateGameHandler(w, r.WithContext(ctx))
-			default:
-				http.Error(w, JsonErrorString("Method Not Allowed"), http.StatusMethodNotAllowed)
-			}
-		} else {
-			if strings.HasSuffix(r.URL.Path, "/events") || strings.HasSuffix(r.URL.Path, "/events/") {
-				switch r.Method {
-				case http.MethodGet:
-					//GET /api/games/{gameID}/events <- Get the event stream
-					ah.GetGameEventsHandler(w, r.WithContext(ctx))
-				case http.MethodPost:
-					//POST /api/games/{gameID}/events <- Put a player event
-					ah.CreateGameEventHandler(w, r.WithContext(ctx))
-				}
-			} else {
-				switch r.Method {
-				case http.MethodGet:
-					//GET /api/games/{gameID}
-					ah.GetGameHandler(w, r.WithContext(ctx))
-				case http.MethodPut:
-					//PUT /api/games/{gameID}
-					ah.UpdateGameHandler(w, r.WithContext(ctx))
-				}
-			}
-		}
-	default:
-		http.Error(w, JsonErrorString("Not Found"), http.StatusNotFound)
-	}
+	ah.router.ServeHTTP(w, r)
+}
 
+// apiHeaders sets the headers every api response shares
+func apiHeaders(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		next.ServeHTTP(w, r)
+	})
 }
 
 func GenUUIDv4() string {
@@ -129,10 +250,3 @@ func GenUUIDv4() string {
 	u[8] = (u[8] | 0x80) & 0xBF
 	return fmt.Sprintf("%x-%x-%x-%x-%x", u[0:4], u[4:6], u[6:8], u[8:10], u[10:])
 }
-func JsonErrorString(s string) string {
-	o := struct {
-		Err string `json:"err"`
-	}{s}
-	b, _ := json.Marshal(&o)
-	return string(b)
-}
@@ -0,0 +1,178 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// Metrics are the prometheus collectors for the api, served on /metrics
+type Metrics struct {
+	Registry *prometheus.Registry
+
+	EventsSubmitted *prometheus.CounterVec
+	EventsRejected  *prometheus.CounterVec
+	LogWrites       prometheus.Histogram
+	HTTPRequests    *prometheus.HistogramVec
+	RateLimited     *prometheus.CounterVec
+	StreamDropped   *prometheus.CounterVec
+	StreamResyncs   *prometheus.CounterVec
+
+	//subscribers counts the open event streams of each game
+	subscribers map[string]int
+	m           sync.Mutex
+}
+
+func NewMetrics(ah *APIHandler) *Metrics {
+	m := &Metrics{
+		Registry: prometheus.NewRegistry(),
+		EventsSubmitted: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "sh_events_submitted_total",
+			Help: "Events accepted by the games, by event type.",
+		}, []string{"type"}),
+		EventsRejected: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "sh_events_rejected_total",
+			Help: "Events the games refused, by event type and error code.",
+		}, []string{"type", "code"}),
+		LogWrites: prometheus.NewHistogram(prometheus.HistogramOpts{
+			Name:    "sh_event_log_write_seconds",
+			Help:    "How long appending to a game event log takes.",
+			Buckets: prometheus.ExponentialBuckets(0.0001, 4, 8),
+		}),
+		HTTPRequests: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name: "sh_http_request_duration_seconds",
+			Help: "How long api requests take, by route pattern, method and status. Event streams count until they close.",
+		}, []string{"route", "method", "code"}),
+		RateLimited: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "sh_rate_limited_total",
+			Help: "Requests turned away for going over a rate limit, by limit.",
+		}, []string{"limit"}),
+		StreamDropped: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "sh_stream_dropped_events_total",
+			Help: "Events dropped from subscribers that fell too far behind, by transport.",
+		}, []string{"transport"}),
+		StreamResyncs: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "sh_stream_resyncs_total",
+			Help: "Times a subscriber that fell too far behind was sent the current state instead, by transport.",
+		}, []string{"transport"}),
+		subscribers: make(map[string]int),
+	}
+	m.Registry.MustRegister(
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+		m.EventsSubmitted,
+		m.EventsRejected,
+		m.LogWrites,
+		m.HTTPRequests,
+		m.RateLimited,
+		m.StreamDropped,
+		m.StreamResyncs,
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Name: "sh_sessions",
+			Help: "Sessions that are logged in.",
+		}, func() float64 {
+			return float64(ah.Sessions.Len())
+		}),
+		&gameCollector{ah: ah},
+	)
+	return m
+}
+
+func (m *Metrics) Handler() http.Handler {
+	return promhttp.HandlerFor(m.Registry, promhttp.HandlerOpts{})
+}
+
+// Subscribe counts an event stream opening on the game, returning the func
+// that counts it closing
+func (m *Metrics) Subscribe(gameID string) func() {
+	m.m.Lock()
+	m.subscribers[gameID]++
+	m.m.Unlock()
+	return func() {
+		m.m.Lock()
+		if m.subscribers[gameID]--; m.subscribers[gameID] <= 0 {
+			delete(m.subscribers, gameID)
+		}
+		m.m.Unlock()
+	}
+}
+
+// ObserveRequest records an api request, route is the pattern it matched
+func (m *Metrics) ObserveRequest(route, method string, status int, d time.Duration) {
+	if route == "" {
+		route = "unmatched"
+	}
+	m.HTTPRequests.WithLabelValues(route, method, strconv.Itoa(status)).Observe(d.Seconds())
+}
+
+// TimeWrites wraps a game event log, timing every append
+func (m *Metrics) TimeWrites(w io.Writer) io.Writer {
+	return timedWriter{w, m.LogWrites}
+}
+
+type timedWriter struct {
+	w io.Writer
+	h prometheus.Histogram
+}
+
+func (tw timedWriter) Write(b []byte) (int, error) {
+	start := time.Now()
+	n, err := tw.w.Write(b)
+	tw.h.Observe(time.Since(start).Seconds())
+	return n, err
+}
+
+var (
+	gamesDesc = prometheus.NewDesc("sh_games",
+		"Games being played, by state.", []string{"state"}, nil)
+	subscribersDesc = prometheus.NewDesc("sh_game_subscribers",
+		"Open event streams, by public game. Private games are counted together as game \"private\".", []string{"game"}, nil)
+)
+
+// gameCollector reads the active games and their subscribers at scrape time
+type gameCollector struct {
+	ah *APIHandler
+}
+
+func (gc *gameCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- gamesDesc
+	ch <- subscribersDesc
+}
+
+func (gc *gameCollector) Collect(ch chan<- prometheus.Metric) {
+	states := map[string]int{}
+	for gameID, shg := range gc.ah.activeGames() {
+		states[gc.ah.gameState(gameID, shg).State]++
+	}
+	for state, n := range states {
+		ch <- prometheus.MustNewConstMetric(gamesDesc, prometheus.GaugeValue, float64(n), state)
+	}
+
+	m := gc.ah.Metrics
+	subscribers := map[string]int{}
+	m.m.Lock()
+	for gameID, n := range m.subscribers {
+		subscribers[gameID] = n
+	}
+	m.m.Unlock()
+	//Metrics aren't behind a login, so private games mustn't be named
+	byGame := map[string]int{}
+	gc.ah.m.RLock()
+	for gameID, n := range subscribers {
+		if meta, ok := gc.ah.Meta[gameID]; ok && meta.Visibility == VisibilityPublic {
+			byGame[gameID] += n
+		} else {
+			byGame[VisibilityPrivate] += n
+		}
+	}
+	gc.ah.m.RUnlock()
+	for game, n := range byGame {
+		ch <- prometheus.MustNewConstMetric(subscribersDesc, prometheus.GaugeValue, float64(n), game)
+	}
+}
@@ -1,28 +1,34 @@
 package main
 
 import (
-	"strings"
 	"time"
 
 	sh "github.com/murphysean/secrethitler"
 )
 
-func getName(id string) string {
-	namesFile := Reader{"games/names.json"}.Read()
+const (
+	VisibilityPublic  = "public"
+	VisibilityPrivate = "private"
+)
 
-	for _, line := range strings.Split(namesFile, "\r\n") {
-		pair := strings.Split(line, ":")
-		if pair[0] == id {
-			return pair[1]
-		}
-	}
-	return ""
+// GameMeta is everything we know about a game that the engine doesn't track
+type GameMeta struct {
+	ID         string            `json:"id"`
+	Name       string            `json:"name"`
+	CreatorID  string            `json:"creatorId"`
+	CreatedAt  time.Time         `json:"createdAt"`
+	Visibility string            `json:"visibility"`
+	Settings   map[string]string `json:"settings,omitempty"`
 }
 
-func GameFromGame(g sh.Game) Game {
+func GameFromGame(g sh.Game, m GameMeta) Game {
 	ret := Game{}
 	ret.ID = g.ID
-	ret.Name = getName(g.ID)
+	ret.Name = m.Name
+	ret.CreatorID = m.CreatorID
+	ret.CreatedAt = m.CreatedAt
+	ret.Visibility = m.Visibility
+	ret.Settings = m.Settings
 	ret.Secret = g.Secret
 	ret.EventID = g.EventID
 	ret.State = g.State
@@ -71,25 +77,29 @@ func GameFromGame(g sh.Game) Game {
 }
 
 type Game struct {
-	ID                         string       `json:"id"`
-	Name                       string       `json:"name"`
-	Secret                     string       `json:"secret"`
-	EventID                    int          `json:"eventId"`
-	State                      string       `json:"state"`
-	Draw                       []string     `json:"draw"`
-	Discard                    []string     `json:"discard"`
-	Liberal                    int          `json:"liberal"`
-	Fascist                    int          `json:"fascist"`
-	ElectionTracker            int          `json:"electionTracker"`
-	Players                    []GamePlayer `json:"players"`
-	Round                      Round        `json:"round"`
-	NextPresidentID            string       `json:"nextPresidentId"`
-	PreviousPresidentID        string       `json:"previousPresidentId"`
-	PreviousChancellorID       string       `json:"previousChancellorId"`
-	PreviousEnactedPolicy      string       `json:"previousEnactedPolicy"`
-	SpecialElectionRoundID     int          `json:"specialElectionRoundId"`
-	SpecialElectionPresidentID string       `json:"specialElectionPresidentId"`
-	WinningParty               string       `json:"winningParty"`
+	ID                         string            `json:"id"`
+	Name                       string            `json:"name"`
+	CreatorID                  string            `json:"creatorId"`
+	CreatedAt                  time.Time         `json:"createdAt"`
+	Visibility                 string            `json:"visibility"`
+	Settings                   map[string]string `json:"settings,omitempty"`
+	Secret                     string            `json:"secret"`
+	EventID                    int               `json:"eventId"`
+	State                      string            `json:"state"`
+	Draw                       []string          `json:"draw"`
+	Discard                    []string          `json:"discard"`
+	Liberal                    int               `json:"liberal"`
+	Fascist                    int               `json:"fascist"`
+	ElectionTracker            int               `json:"electionTracker"`
+	Players                    []GamePlayer      `json:"players"`
+	Round                      Round             `json:"round"`
+	NextPresidentID            string            `json:"nextPresidentId"`
+	PreviousPresidentID        string            `json:"previousPresidentId"`
+	PreviousChancellorID       string            `json:"previousChancellorId"`
+	PreviousEnactedPolicy      string            `json:"previousEnactedPolicy"`
+	SpecialElectionRoundID     int               `json:"specialElectionRoundId"`
+	SpecialElectionPresidentID string            `json:"specialElectionPresidentId"`
+	WinningParty               string            `json:"winningParty"`
 }
 
 type GamePlayer struct {
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"fmt"
+	"math/rand"
+	"sort"
+	"sync"
+)
+
+// nameThemes are the word lists game names are built from
+var nameThemes = map[string]struct {
+	Adjectives []string
+	Nouns      []string
+}{
+	"parliament": {
+		Adjectives: []string{
+			"secret", "liberal", "fascist", "shadowy", "loyal", "sneaky",
+			"elected", "vetoed", "exiled", "hidden", "trusted", "suspicious",
+			"silent", "radical", "cunning", "honest", "scheming", "doomed",
+		},
+		Nouns: []string{
+			"chancellor", "president", "policy", "ballot", "vote", "cabinet",
+			"senate", "tracker", "election", "decree", "assembly", "coalition",
+			"minister", "session", "agenda", "faction", "veto", "spy",
+		},
+	},
+	"noir": {
+		Adjectives: []string{
+			"foggy", "smoky", "crooked", "midnight", "velvet", "rainy",
+			"dim", "gilded", "hushed", "faded", "whispering", "lonely",
+		},
+		Nouns: []string{
+			"alley", "speakeasy", "dossier", "telegram", "informant", "trenchcoat",
+			"cipher", "lamppost", "ledger", "envelope", "detective", "railcar",
+		},
+	},
+}
+
+// NameGenerator builds lobby friendly names like "sneaky-chancellor-42"
+type NameGenerator struct {
+	Adjectives []string
+	Nouns      []string
+	rnd        *rand.Rand
+	m          sync.Mutex
+}
+
+// NewNameGenerator creates a generator for the named theme. The same seed
+// always produces the same sequence of names.
+func NewNameGenerator(theme string, seed int64) (*NameGenerator, error) {
+	t, ok := nameThemes[theme]
+	if !ok {
+		themes := []string{}
+		for k := range nameThemes {
+			themes = append(themes, k)
+		}
+		sort.Strings(themes)
+		return nil, fmt.Errorf("unknown name theme %q, choose one of %v", theme, themes)
+	}
+	return &NameGenerator{
+		Adjectives: t.Adjectives,
+		Nouns:      t.Nouns,
+		rnd:        rand.New(rand.NewSource(seed)),
+	}, nil
+}
+
+// maxNameNumber is as wide as the number in a name gets before Generate
+// gives up on short names
+const maxNameNumber = 1000000
+
+// Generate returns a name that taken reports as unused. Once the short names
+// seem used up it falls back to a uuid suffix rather than keep looking.
+func (ng *NameGenerator) Generate(taken func(name string) bool) string {
+	ng.m.Lock()
+	defer ng.m.Unlock()
+	for limit := 100; limit <= maxNameNumber; limit *= 10 {
+		//Try a handful of random names before widening the number range
+		for i := 0; i < 10; i++ {
+			name := fmt.Sprintf("%s-%s-%d", ng.adjective(), ng.noun(), ng.rnd.Intn(limit))
+			if taken == nil || !taken(name) {
+				return name
+			}
+		}
+	}
+	return fmt.Sprintf("%s-%s-%s", ng.adjective(), ng.noun(), GenUUIDv4())
+}
+
+func (ng *NameGenerator) adjective() string {
+	return ng.Adjectives[ng.rnd.Intn(len(ng.Adjectives))]
+}
+
+func (ng *NameGenerator) noun() string {
+	return ng.Nouns[ng.rnd.Intn(len(ng.Nouns))]
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestNameGeneratorSeeded(t *testing.T) {
+	names := func(seed int64) []string {
+		ng, err := NewNameGenerator("parliament", seed)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ret := []string{}
+		for i := 0; i < 5; i++ {
+			ret = append(ret, ng.Generate(nil))
+		}
+		return ret
+	}
+	first := names(42)
+	if again := names(42); !reflect.DeepEqual(first, again) {
+		t.Errorf("seed 42 gave %v then %v", first, again)
+	}
+	if other := names(43); reflect.DeepEqual(first, other) {
+		t.Errorf("seeds 42 and 43 both gave %v", first)
+	}
+	if _, err := NewNameGenerator("nope", 1); err == nil {
+		t.Error("unknown theme accepted")
+	}
+}
+
+func TestNameGeneratorSkipsTaken(t *testing.T) {
+	ng, _ := NewNameGenerator("noir", 7)
+	first := ng.Generate(nil)
+
+	//The same seed comes up with first again, which is now taken
+	ng, _ = NewNameGenerator("noir", 7)
+	tries := 0
+	name := ng.Generate(func(name string) bool {
+		tries++
+		return name == first
+	})
+	if name == first {
+		t.Errorf("got the taken name %s", name)
+	}
+	if tries != 2 {
+		t.Errorf("took %d tries, want 2", tries)
+	}
+}
+
+func TestNameGeneratorAllTaken(t *testing.T) {
+	ng, _ := NewNameGenerator("parliament", 1)
+	tries := 0
+	name := ng.Generate(func(name string) bool {
+		tries++
+		return strings.Count(name, "-") == 2
+	})
+	if strings.Count(name, "-") == 2 {
+		t.Errorf("got %s when every short name is taken", name)
+	}
+	if tries != 50 {
+		t.Errorf("took %d tries, want 50", tries)
+	}
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"strings"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+var passwordCost = bcrypt.DefaultCost
+
+// maxPasswordBytes is the longest password bcrypt hashes
+const maxPasswordBytes = 72
+
+// validatePassword checks a new password can be hashed, naming the field it
+// came from when it can't
+func validatePassword(field, password string) error {
+	if len(password) > maxPasswordBytes {
+		return &FieldError{Field: field, Message: "must be at most 72 bytes"}
+	}
+	return nil
+}
+
+// hashPassword salts and hashes a password for storage on the player
+func hashPassword(password string) (string, error) {
+	b, err := bcrypt.GenerateFromPassword([]byte(password), passwordCost)
+	if err != nil {
+		return "", err
+	}
+	return string(b), nil
+}
+
+// checkPassword reports whether the password matches the stored hash, and
+// whether the hash is outdated and should be replaced with hashPassword.
+// Accounts created before bcrypt have an HMAC-SHA256 keyed by their email.
+func checkPassword(email, password, hash string) (ok, rehash bool) {
+	if !strings.HasPrefix(hash, "$2") {
+		sig := hmac.New(sha256.New, []byte(email))
+		sig.Write([]byte(password))
+		legacy := base64.URLEncoding.EncodeToString(sig.Sum(nil))
+		ok = hmac.Equal([]byte(legacy), []byte(hash))
+		return ok, ok
+	}
+	if bcrypt.CompareHashAndPassword([]byte(hash), []byte(password)) != nil {
+		return false, false
+	}
+	cost, err := bcrypt.Cost([]byte(hash))
+	return true, err != nil || cost < passwordCost
+}
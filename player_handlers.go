@@ -1,18 +1,10 @@
 package main
 
 import (
+	"bytes"
 	"context"
-	"crypto/hmac"
-	"crypto/md5"
-	"crypto/sha256"
-	"encoding/base64"
 	"encoding/json"
-	"errors"
-	"fmt"
-	"io/ioutil"
 	"net/http"
-	"os"
-	"regexp"
 	"strings"
 )
 
@@ -24,124 +16,98 @@ type Player struct {
 	ThumbnailURL string `json:"thumbnailUrl"`
 	Password     string `json:"password,omitempty"`
 	PasswordHash string `json:"passwordHash,omitempty"`
+	Role         string `json:"role,omitempty"`
 }
 
-type Gravatar struct {
-	ID                string `json:"id"`
-	PreferredUseranme string `json:"preferredUseranme"`
-	ThumbnailURL      string `json:"thumbnailUrl"`
-	/*
-		Name              struct {
-			GivenName  string `json:"givenName"`
-			FamilyName string `json:"familyName"`
-			Formatted  string `json:"formatted"`
-		} `json:"name"`
-	*/
-	DisplayName     string `json:"displayName"`
-	CurrentLocation string `json:"currentLocation"`
-}
-
-func GetGravatar(email string) (*Gravatar, error) {
-	//Look up the gravatar information
-	te := strings.TrimSpace(email)
-	le := strings.ToLower(te)
-	h := md5.New()
-	h.Write([]byte(le))
-	hash := h.Sum(nil)
-	ghash := fmt.Sprintf("%x", hash)
-
-	resp, err := http.Get("https://www.gravatar.com/" + ghash + ".json")
-	if err != nil {
-		return nil, err
-	}
-	defer resp.Body.Close()
-	if resp.StatusCode != http.StatusOK {
-		return nil, errors.New(resp.Status + " response")
-	}
-	d := json.NewDecoder(resp.Body)
-	ro := struct {
-		Entry []Gravatar `json:"entry"`
-	}{}
-	err = d.Decode(&ro)
-	if err != nil {
-		return nil, err
-	}
-
-	if ro.Entry == nil && len(ro.Entry) < 1 {
-		return nil, errors.New("Gravatar resp empty")
+// GetRole is the role of the player, players from before roles are players
+func (p *Player) GetRole() string {
+	if p.Role == "" {
+		return RolePlayer
 	}
-
-	return &ro.Entry[0], nil
+	return p.Role
 }
 
-func GetPlayer(ctx context.Context, id string) (*Player, error) {
+func (ah *APIHandler) GetPlayer(ctx context.Context, id string) (*Player, error) {
 	if id == "me" {
 		id, _ = ctx.Value("playerID").(string)
 	}
-	b, err := ioutil.ReadFile("players/" + id + ".json")
-	if err != nil {
-		return nil, err
-	}
-	p := Player{}
-	err = json.Unmarshal(b, &p)
-	if err != nil {
-		return nil, err
-	}
-
-	return &p, err
+	return ah.Store.GetPlayer(id)
 }
 
-func (ah APIHandler) CreatePlayerHandler(w http.ResponseWriter, r *http.Request) {
+func (ah *APIHandler) CreatePlayerHandler(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "application/json")
 	//Given a email and a password, create this user
 
 	//Pull in the player object
-	p := Player{}
-	d := json.NewDecoder(r.Body)
-	err := d.Decode(&p)
+	//Only what a new player picks for themselves, the rest is worked out here
+	body := struct {
+		Email    string `json:"email"`
+		Username string `json:"username"`
+		Name     string `json:"name"`
+		Password string `json:"password"`
+	}{}
+	err := decodeJSON(r, &body)
+	if err == nil {
+		err = requireFields(map[string]string{"email": body.Email, "password": body.Password})
+	}
+	if err == nil && !strings.Contains(body.Email, "@") {
+		err = &FieldError{Field: "email", Message: "must be an email address"}
+	}
+	if err == nil {
+		err = validatePassword("password", body.Password)
+	}
 	if err != nil {
-		fmt.Println(err)
-		http.Error(w, JsonErrorString(err.Error()), http.StatusBadRequest)
+		ah.logger(r).Warn("decode player", "err", err)
+		WriteError(w, err)
 		return
 	}
+	p := Player{
+		Email:    strings.TrimSpace(body.Email),
+		Username: body.Username,
+		Name:     body.Name,
+		Password: body.Password,
+	}
 
-	g, err := GetGravatar(p.Email)
+	//Ensure that the user doesn't already exist
+	if _, err := ah.Store.FindPlayerByEmail(p.Email); err == nil {
+		WriteError(w, NewAPIError(http.StatusConflict, CodePlayerExists, "User already exists"))
+		return
+	}
+
+	name := p.Name
+	if name == "" {
+		name = p.Username
+	}
+	prof, err := ah.Profiles.Profile(r.Context(), p.Email, name)
 	if err != nil {
-		fmt.Println(err)
-		fmt.Println("error getting gravatar")
-		http.Error(w, JsonErrorString(err.Error()), http.StatusInternalServerError)
+		ah.logger(r).Error("get profile", "err", err)
+		WriteError(w, err)
 		return
 	}
 
-	//Ensure that the user doesn't already exist
-	if _, err := os.Stat("players/" + p.ID + ".json"); err == nil {
-		http.Error(w, JsonErrorString("User already exists"), http.StatusConflict)
+	p.ID = prof.ID
+	if _, err := ah.Store.GetPlayer(p.ID); err == nil {
+		WriteError(w, NewAPIError(http.StatusConflict, CodePlayerExists, "User already exists"))
 		return
 	}
 
-	p.ID = g.ID
-	p.Name = g.DisplayName
-	p.ThumbnailURL = g.ThumbnailURL
-	p.Username = g.DisplayName
+	p.Name = prof.Name
+	p.ThumbnailURL = prof.ThumbnailURL
+	p.Username = prof.Username
+	p.Role = RolePlayer
 
-	sig := hmac.New(sha256.New, []byte(p.Email))
-	sig.Write([]byte(p.Password))
+	p.PasswordHash, err = hashPassword(p.Password)
 	p.Password = ""
-	p.PasswordHash = base64.URLEncoding.EncodeToString(sig.Sum(nil))
-
-	b, err := json.Marshal(&p)
 	if err != nil {
-		fmt.Println(err)
-		fmt.Println("Error marshaling password?")
-		http.Error(w, JsonErrorString(err.Error()), http.StatusInternalServerError)
+		ah.logger(r).Error("hash password", "err", err)
+		WriteError(w, err)
 		return
 	}
 
-	err = ioutil.WriteFile("players/"+p.ID+".json", b, os.ModePerm)
+	err = ah.Store.PutPlayer(&p)
 	if err != nil {
-		fmt.Println(err)
-		fmt.Println("error writing to file")
-		http.Error(w, JsonErrorString(err.Error()), http.StatusInternalServerError)
+		ah.logger(r).Error("store player", "err", err)
+		WriteError(w, err)
 		return
 	}
 	p.PasswordHash = ""
@@ -153,24 +119,262 @@ func (ah APIHandler) CreatePlayerHandler(w http.ResponseWriter, r *http.Request)
 	e.Encode(&p)
 }
 
-var pre = regexp.MustCompile(`^/api/players/([^/]+)/?$`)
+func (ah *APIHandler) GetPlayerHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	p, err := ah.GetPlayer(r.Context(), PathParam(r, "playerID"))
+	if err != nil {
+		WriteError(w, NewAPIError(http.StatusNotFound, CodeNotFound, "Not Found"))
+		return
+	}
+	p.Password = ""
+	p.PasswordHash = ""
+
+	e := json.NewEncoder(w)
+	e.Encode(&p)
+}
+
+// canEditPlayer reports whether the authenticated player may change the
+// account of the player with the id, players can always change their own
+func canEditPlayer(ctx context.Context, id, role string) bool {
+	playerID, _ := ctx.Value("playerID").(string)
+	return playerID != "" && (playerID == id || hasRole(ctx, role))
+}
 
-func (ah APIHandler) GetPlayerHandler(w http.ResponseWriter, r *http.Request) {
+func (ah *APIHandler) UpdatePlayerHandler(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "application/json")
-	rer := pre.FindStringSubmatch(r.URL.Path)
-	if len(rer) != 2 {
-		http.Error(w, JsonErrorString("No PlayerID found"), http.StatusBadRequest)
+	p, err := ah.GetPlayer(r.Context(), PathParam(r, "playerID"))
+	if err != nil {
+		WriteError(w, NewAPIError(http.StatusNotFound, CodeNotFound, "Not Found"))
+		return
+	}
+	if !canEditPlayer(r.Context(), p.ID, RoleAdmin) {
+		WriteError(w, NewAPIError(http.StatusForbidden, CodeForbidden, "Forbidden"))
 		return
 	}
 
-	p, err := GetPlayer(r.Context(), rer[1])
+	//Nil fields are left alone on a PATCH, and cleared on a PUT
+	u := struct {
+		Email        *string `json:"email"`
+		Username     *string `json:"username"`
+		Name         *string `json:"name"`
+		ThumbnailURL *string `json:"thumbnailUrl"`
+		Role         *string `json:"role"`
+	}{}
+	err = decodeJSON(r, &u)
 	if err != nil {
-		http.Error(w, JsonErrorString("Not Found"), http.StatusNotFound)
+		WriteError(w, err)
+		return
+	}
+	set := func(dst *string, src *string) {
+		if src != nil {
+			*dst = strings.TrimSpace(*src)
+		} else if r.Method == http.MethodPut {
+			*dst = ""
+		}
+	}
+	email := p.Email
+	set(&p.Email, u.Email)
+	set(&p.Username, u.Username)
+	set(&p.Name, u.Name)
+	set(&p.ThumbnailURL, u.ThumbnailURL)
+	if err := requireFields(map[string]string{"email": p.Email, "name": p.Name}); err != nil {
+		WriteError(w, err)
 		return
 	}
+	if p.Username == "" {
+		p.Username = p.Name
+	}
+	role := p.GetRole()
+	if u.Role != nil && *u.Role != role {
+		if !hasRole(r.Context(), RoleAdmin) {
+			WriteError(w, NewAPIError(http.StatusForbidden, CodeForbidden, "Only admins can change roles"))
+			return
+		}
+		if _, ok := roleRanks[*u.Role]; !ok {
+			WriteError(w, &FieldError{Field: "role", Message: "must be player, moderator or admin"})
+			return
+		}
+		p.Role = *u.Role
+	}
+
+	if !strings.EqualFold(p.Email, email) {
+		if o, err := ah.Store.FindPlayerByEmail(p.Email); err == nil && o.ID != p.ID {
+			WriteError(w, NewAPIError(http.StatusConflict, CodeEmailInUse, "Email already in use"))
+			return
+		}
+		//Old password hashes are keyed by email, logging in upgrades them
+		if !strings.HasPrefix(p.PasswordHash, "$2") {
+			WriteError(w, NewAPIError(http.StatusConflict, CodeConflict, "Log in again before changing your email"))
+			return
+		}
+	}
+
+	err = ah.Store.PutPlayer(p)
+	if err != nil {
+		ah.logger(r).Error("store player", "err", err)
+		WriteError(w, err)
+		return
+	}
+	if p.GetRole() != role {
+		ah.Sessions.SetRole(p.ID, p.GetRole())
+	}
 	p.Password = ""
 	p.PasswordHash = ""
 
 	e := json.NewEncoder(w)
 	e.Encode(&p)
 }
+
+func (ah *APIHandler) ChangePasswordHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	p, err := ah.GetPlayer(r.Context(), PathParam(r, "playerID"))
+	if err != nil {
+		WriteError(w, NewAPIError(http.StatusNotFound, CodeNotFound, "Not Found"))
+		return
+	}
+	//Only the player themselves knows the old password
+	if playerID, _ := r.Context().Value("playerID").(string); playerID != p.ID {
+		WriteError(w, NewAPIError(http.StatusForbidden, CodeForbidden, "Forbidden"))
+		return
+	}
+
+	creds := struct {
+		OldPassword string `json:"oldPassword"`
+		NewPassword string `json:"newPassword"`
+	}{}
+	err = decodeJSON(r, &creds)
+	if err == nil {
+		err = requireFields(map[string]string{"newPassword": creds.NewPassword})
+	}
+	if err == nil {
+		err = validatePassword("newPassword", creds.NewPassword)
+	}
+	if err != nil {
+		WriteError(w, err)
+		return
+	}
+	if ok, _ := checkPassword(p.Email, creds.OldPassword, p.PasswordHash); !ok {
+		WriteError(w, NewAPIError(http.StatusUnauthorized, CodeBadCredentials, "Unauthorized"))
+		return
+	}
+
+	p.PasswordHash, err = hashPassword(creds.NewPassword)
+	if err == nil {
+		err = ah.Store.PutPlayer(p)
+	}
+	if err != nil {
+		ah.logger(r).Error("change password", "err", err)
+		WriteError(w, err)
+		return
+	}
+	//Everywhere else has to log in with the new password
+	sessionID, _ := r.Context().Value("sessionID").(string)
+	ah.Sessions.RevokeAll(p.ID, sessionID)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (ah *APIHandler) DeletePlayerHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	p, err := ah.GetPlayer(r.Context(), PathParam(r, "playerID"))
+	if err != nil {
+		WriteError(w, NewAPIError(http.StatusNotFound, CodeNotFound, "Not Found"))
+		return
+	}
+	if !canEditPlayer(r.Context(), p.ID, RoleAdmin) {
+		WriteError(w, NewAPIError(http.StatusForbidden, CodeForbidden, "Forbidden"))
+		return
+	}
+
+	//From here on the player can't submit to any game, so once a game has
+	//been checked they can't turn up in it
+	ah.m.Lock()
+	ah.deleting[p.ID] = true
+	ah.m.Unlock()
+	defer func() {
+		ah.m.Lock()
+		delete(ah.deleting, p.ID)
+		ah.m.Unlock()
+	}()
+	for gameID, shg := range ah.activeGames() {
+		if g := ah.gameState(gameID, shg); !gameOver(g) && inGame(g, p.ID) {
+			WriteError(w, NewAPIError(http.StatusConflict, CodePlayerInGame, "Player is in an unfinished game"))
+			return
+		}
+	}
+
+	err = ah.anonymizePlayer(p.ID, "deleted-"+GenUUIDv4())
+	if err == nil {
+		err = ah.Store.DeletePlayer(p.ID)
+	}
+	if err != nil {
+		ah.logger(r).Error("delete player", "deletedPlayerID", p.ID, "err", err)
+		WriteError(w, err)
+		return
+	}
+	ah.Sessions.RevokeAll(p.ID, "")
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// anonymizePlayer replaces the id of the player with anonID in the log of
+// every finished game and every game they created. Unfinished games are still
+// being written to and are left alone.
+func (ah *APIHandler) anonymizePlayer(id, anonID string) error {
+	gameIDs, err := ah.Store.GameIDs()
+	if err != nil {
+		return err
+	}
+	quoted, _ := json.Marshal(id)
+	anon, _ := json.Marshal(anonID)
+	for _, gameID := range gameIDs {
+		if err := ah.anonymizeGameLog(gameID, quoted, anon); err != nil {
+			return err
+		}
+		if m := ah.gameMeta(gameID); m.CreatorID == id {
+			m.CreatorID = anonID
+			if err := ah.Store.PutGameMeta(&m); err != nil {
+				return err
+			}
+			ah.m.Lock()
+			ah.Meta[gameID] = &m
+			ah.m.Unlock()
+		}
+	}
+	return nil
+}
+
+// anonymizeGameLog swaps the quoted ids in the log of a game unless it is
+// still being played. An active game is held only while its own log is
+// rewritten, and gets its state rebuilt from the new log so the two match.
+// Any other game is over and no longer written to, so needs no lock.
+func (ah *APIHandler) anonymizeGameLog(gameID string, quoted, anon []byte) error {
+	rewrite := func() error {
+		return ah.Store.RewriteEventLog(gameID, func(line []byte) []byte {
+			return bytes.Replace(line, quoted, anon, -1)
+		})
+	}
+	//Games are added to the active ones under their lock, see CreateGameHandler
+	l := ah.gameLock(gameID)
+	l.Lock()
+	ah.m.RLock()
+	shg, active := ah.ActiveGames[gameID]
+	ah.m.RUnlock()
+	if !active {
+		l.Unlock()
+		return rewrite()
+	}
+	defer l.Unlock()
+	if !gameOver(shg.Game) {
+		return nil
+	}
+	if err := rewrite(); err != nil {
+		return err
+	}
+	g, err := ah.replayGameLog(gameID)
+	if err != nil {
+		return err
+	}
+	g.ID = gameID
+	shg.Game = g
+	return nil
+}
@@ -0,0 +1,234 @@
+package main
+
+import (
+	"context"
+	"crypto/md5"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Profile is the public face of a new player
+type Profile struct {
+	ID           string
+	Username     string
+	Name         string
+	ThumbnailURL string
+}
+
+// ProfileProvider comes up with the profile for a player registering with
+// the email, and the name they asked for (which may be empty)
+type ProfileProvider interface {
+	Profile(ctx context.Context, email, name string) (*Profile, error)
+}
+
+// emailHash is the md5 of the trimmed, lowercased email gravatar keys on
+func emailHash(email string) string {
+	h := md5.New()
+	h.Write([]byte(strings.ToLower(strings.TrimSpace(email))))
+	return fmt.Sprintf("%x", h.Sum(nil))
+}
+
+// LocalProfileProvider needs nothing but the server itself, avatars are
+// identicons served from /avatars/
+type LocalProfileProvider struct{}
+
+func (LocalProfileProvider) Profile(ctx context.Context, email, name string) (*Profile, error) {
+	name = strings.TrimSpace(name)
+	if name == "" {
+		name = strings.SplitN(strings.TrimSpace(email), "@", 2)[0]
+	}
+	return &Profile{
+		ID:           GenUUIDv4(),
+		Username:     name,
+		Name:         name,
+		ThumbnailURL: "/avatars/" + emailHash(email) + ".svg",
+	}, nil
+}
+
+type Gravatar struct {
+	ID                string `json:"id"`
+	PreferredUseranme string `json:"preferredUseranme"`
+	ThumbnailURL      string `json:"thumbnailUrl"`
+	/*
+		Name              struct {
+			GivenName  string `json:"givenName"`
+			FamilyName string `json:"familyName"`
+			Formatted  string `json:"formatted"`
+		} `json:"name"`
+	*/
+	DisplayName     string `json:"displayName"`
+	CurrentLocation string `json:"currentLocation"`
+}
+
+func GetGravatar(ctx context.Context, client *http.Client, email string) (*Gravatar, error) {
+	//Look up the gravatar information
+	req, err := http.NewRequest(http.MethodGet, "https://www.gravatar.com/"+emailHash(email)+".json", nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := client.Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, errors.New(resp.Status + " response")
+	}
+	d := json.NewDecoder(resp.Body)
+	ro := struct {
+		Entry []Gravatar `json:"entry"`
+	}{}
+	err = d.Decode(&ro)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(ro.Entry) < 1 {
+		return nil, errors.New("Gravatar resp empty")
+	}
+
+	return &ro.Entry[0], nil
+}
+
+// GravatarProfileProvider enriches the local profile with the player's
+// gravatar when gravatar.com can be reached, caching the lookups
+type GravatarProfileProvider struct {
+	Local    LocalProfileProvider
+	Client   *http.Client
+	CacheTTL time.Duration
+
+	cache map[string]gravatarCacheEntry
+	m     sync.Mutex
+
+	pingErr     error
+	pingExpires time.Time
+}
+
+type gravatarCacheEntry struct {
+	gravatar *Gravatar
+	err      error
+	expires  time.Time
+}
+
+func NewGravatarProfileProvider(timeout, cacheTTL time.Duration) *GravatarProfileProvider {
+	return &GravatarProfileProvider{
+		Client:   &http.Client{Timeout: timeout},
+		CacheTTL: cacheTTL,
+		cache:    make(map[string]gravatarCacheEntry),
+	}
+}
+
+func (gp *GravatarProfileProvider) Profile(ctx context.Context, email, name string) (*Profile, error) {
+	p, err := gp.Local.Profile(ctx, email, name)
+	if err != nil {
+		return nil, err
+	}
+	g, err := gp.lookup(ctx, email)
+	if err != nil {
+		//No gravatar, or no internet, the local profile will do
+		return p, nil
+	}
+	p.ID = g.ID
+	if name == "" && g.DisplayName != "" {
+		p.Name = g.DisplayName
+		p.Username = g.DisplayName
+	}
+	if g.ThumbnailURL != "" {
+		p.ThumbnailURL = g.ThumbnailURL
+	}
+	return p, nil
+}
+
+func (gp *GravatarProfileProvider) lookup(ctx context.Context, email string) (*Gravatar, error) {
+	key := emailHash(email)
+	gp.m.Lock()
+	ce, ok := gp.cache[key]
+	gp.m.Unlock()
+	if ok && time.Now().Before(ce.expires) {
+		return ce.gravatar, ce.err
+	}
+
+	g, err := GetGravatar(ctx, gp.Client, email)
+	gp.m.Lock()
+	gp.cache[key] = gravatarCacheEntry{gravatar: g, err: err, expires: time.Now().Add(gp.CacheTTL)}
+	gp.m.Unlock()
+	return g, err
+}
+
+// Ping checks gravatar.com can be reached, remembering the answer for a
+// minute so readiness probes don't hammer it
+func (gp *GravatarProfileProvider) Ping(ctx context.Context) error {
+	gp.m.Lock()
+	defer gp.m.Unlock()
+	if time.Now().Before(gp.pingExpires) {
+		return gp.pingErr
+	}
+	req, err := http.NewRequest(http.MethodHead, "https://www.gravatar.com/avatar/", nil)
+	if err != nil {
+		return err
+	}
+	resp, err := gp.Client.Do(req.WithContext(ctx))
+	if err == nil {
+		resp.Body.Close()
+		if resp.StatusCode >= 500 {
+			err = errors.New(resp.Status + " response")
+		}
+	}
+	gp.pingErr = err
+	gp.pingExpires = time.Now().Add(time.Minute)
+	return err
+}
+
+// NewProfileProvider returns the provider named by kind
+func NewProfileProvider(kind string, timeout time.Duration) (ProfileProvider, error) {
+	switch kind {
+	case "local":
+		return LocalProfileProvider{}, nil
+	case "gravatar", "":
+		return NewGravatarProfileProvider(timeout, time.Hour), nil
+	}
+	return nil, errors.New("unknown profile provider: " + kind)
+}
+
+var avatarRe = regexp.MustCompile(`^/avatars/([0-9a-f]{32})\.svg$`)
+
+// AvatarHandler draws a 5x5 mirrored identicon from the email hash in the
+// path, so players have a picture without any outside service
+func AvatarHandler(w http.ResponseWriter, r *http.Request) {
+	rer := avatarRe.FindStringSubmatch(r.URL.Path)
+	if len(rer) != 2 {
+		http.NotFound(w, r)
+		return
+	}
+	hash := rer[1]
+	w.Header().Set("Content-Type", "image/svg+xml")
+	w.Header().Set("Cache-Control", "public, max-age=86400")
+	fmt.Fprintf(w, `<svg xmlns="http://www.w3.org/2000/svg" viewBox="0 0 5 5" width="80" height="80" shape-rendering="crispEdges">`)
+	fmt.Fprintf(w, `<rect width="5" height="5" fill="#f0f0f0"/>`)
+	color := "#" + hash[26:32]
+	for i := 0; i < 15; i++ {
+		//Each nibble turns a cell of the left three columns on or off
+		if hexNibble(hash[i])%2 == 1 {
+			continue
+		}
+		x, y := i/5, i%5
+		fmt.Fprintf(w, `<rect x="%d" y="%d" width="1" height="1" fill="%s"/>`, x, y, color)
+		if x != 2 {
+			fmt.Fprintf(w, `<rect x="%d" y="%d" width="1" height="1" fill="%s"/>`, 4-x, y, color)
+		}
+	}
+	fmt.Fprintf(w, `</svg>`)
+}
+
+func hexNibble(c byte) byte {
+	if c >= 'a' {
+		return c - 'a' + 10
+	}
+	return c - '0'
+}
@@ -0,0 +1,224 @@
+package main
+
+import (
+	"math"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	sh "github.com/murphysean/secrethitler"
+)
+
+// RateLimit is a token bucket budget, Burst requests at once refilling at
+// Rate a second
+type RateLimit struct {
+	Rate  float64
+	Burst float64
+}
+
+// rateLimits are the budgets by name, routes are limited per ip and game
+// events per player, with chat and reactions on their own tighter budgets
+var rateLimits = map[string]RateLimit{
+	"login":    {Rate: 1.0 / 6, Burst: 10},
+	"register": {Rate: 1.0 / 60, Burst: 5},
+	"events":   {Rate: 5, Burst: 30},
+	"message":  {Rate: 0.5, Burst: 5},
+	"react":    {Rate: 1, Burst: 10},
+}
+
+type bucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// RateLimiter keeps a token bucket per limit and key
+type RateLimiter struct {
+	Limits map[string]RateLimit
+
+	buckets map[string]*bucket
+	m       sync.Mutex
+}
+
+func NewRateLimiter(limits map[string]RateLimit) *RateLimiter {
+	return &RateLimiter{
+		Limits:  limits,
+		buckets: make(map[string]*bucket),
+	}
+}
+
+// Allow takes a token from the bucket of key under the named limit, or says
+// how long until one is available
+func (rl *RateLimiter) Allow(name, key string) (bool, time.Duration) {
+	limit, ok := rl.Limits[name]
+	if !ok {
+		return true, 0
+	}
+	now := time.Now()
+	rl.m.Lock()
+	defer rl.m.Unlock()
+	b, ok := rl.buckets[name+"|"+key]
+	if !ok {
+		b = &bucket{tokens: limit.Burst, last: now}
+		rl.buckets[name+"|"+key] = b
+	}
+	b.tokens = math.Min(limit.Burst, b.tokens+now.Sub(b.last).Seconds()*limit.Rate)
+	b.last = now
+	if b.tokens >= 1 {
+		b.tokens--
+		return true, 0
+	}
+	return false, time.Duration((1 - b.tokens) / limit.Rate * float64(time.Second))
+}
+
+// Prune forgets buckets that have filled back up
+func (rl *RateLimiter) Prune() {
+	now := time.Now()
+	rl.m.Lock()
+	defer rl.m.Unlock()
+	for k, b := range rl.buckets {
+		limit := rl.Limits[k[:strings.Index(k, "|")]]
+		if b.tokens+now.Sub(b.last).Seconds()*limit.Rate >= limit.Burst {
+			delete(rl.buckets, k)
+		}
+	}
+}
+
+// eventLimit is the budget an event type is posted under
+func eventLimit(eventType string) string {
+	switch {
+	case eventType == sh.TypePlayerMessage:
+		return "message"
+	case strings.HasPrefix(eventType, "react."):
+		return "react"
+	}
+	return "events"
+}
+
+// clientIP is the address the request came from, without the port
+func clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// tooManyRequests is a 429 telling the client when to try again, WriteError
+// turns the retryAfter detail into the Retry-After header
+func tooManyRequests(retryAfter time.Duration, code, message string) *APIError {
+	seconds := int(math.Ceil(retryAfter.Seconds()))
+	return NewAPIError(http.StatusTooManyRequests, code, message).With("retryAfter", seconds)
+}
+
+// checkLimit takes a token from the named limit for key, returning a 429
+// APIError when it is used up
+func (ah *APIHandler) checkLimit(r *http.Request, name, key string) *APIError {
+	if !ah.Config.RateLimits {
+		return nil
+	}
+	ok, retryAfter := ah.Limiter.Allow(name, key)
+	if ok {
+		return nil
+	}
+	ah.logger(r).Warn("rate limited", "limit", name, "key", key)
+	ah.Metrics.RateLimited.WithLabelValues(name).Inc()
+	return tooManyRequests(retryAfter, CodeRateLimited, "Too Many Requests").With("limit", name)
+}
+
+// allow checks the named limit for key, answering 429 when it is used up
+func (ah *APIHandler) allow(w http.ResponseWriter, r *http.Request, name, key string) bool {
+	if ae := ah.checkLimit(r, name, key); ae != nil {
+		WriteError(w, ae)
+		return false
+	}
+	return true
+}
+
+// limitByIP wraps a route with the named limit, per client ip
+func (ah *APIHandler) limitByIP(name string, h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if ah.allow(w, r, name, clientIP(r)) {
+			h(w, r)
+		}
+	}
+}
+
+// LoginLockout locks an account out of password logins for a while after
+// too many failed attempts in a row
+type LoginLockout struct {
+	MaxFailures int
+	Lockout     time.Duration
+
+	failures map[string]*loginFailures
+	m        sync.Mutex
+}
+
+type loginFailures struct {
+	count       int
+	last        time.Time
+	lockedUntil time.Time
+}
+
+func NewLoginLockout(maxFailures int, lockout time.Duration) *LoginLockout {
+	return &LoginLockout{
+		MaxFailures: maxFailures,
+		Lockout:     lockout,
+		failures:    make(map[string]*loginFailures),
+	}
+}
+
+func lockoutKey(email string) string {
+	return strings.ToLower(strings.TrimSpace(email))
+}
+
+// Locked says how much longer the account is locked out, 0 if it isn't
+func (ll *LoginLockout) Locked(email string) time.Duration {
+	ll.m.Lock()
+	defer ll.m.Unlock()
+	if f, ok := ll.failures[lockoutKey(email)]; ok {
+		if d := time.Until(f.lockedUntil); d > 0 {
+			return d
+		}
+	}
+	return 0
+}
+
+// Fail records a failed login, locking the account once there are too many
+func (ll *LoginLockout) Fail(email string) {
+	ll.m.Lock()
+	defer ll.m.Unlock()
+	now := time.Now()
+	f, ok := ll.failures[lockoutKey(email)]
+	//Failures from long ago don't count towards the next lockout
+	if !ok || now.Sub(f.last) > ll.Lockout {
+		f = &loginFailures{}
+		ll.failures[lockoutKey(email)] = f
+	}
+	f.count++
+	f.last = now
+	if f.count >= ll.MaxFailures {
+		f.count = 0
+		f.lockedUntil = now.Add(ll.Lockout)
+	}
+}
+
+// Succeed clears the failures of the account
+func (ll *LoginLockout) Succeed(email string) {
+	ll.m.Lock()
+	defer ll.m.Unlock()
+	delete(ll.failures, lockoutKey(email))
+}
+
+// Prune forgets failures that no longer count
+func (ll *LoginLockout) Prune() {
+	ll.m.Lock()
+	defer ll.m.Unlock()
+	now := time.Now()
+	for k, f := range ll.failures {
+		if now.Sub(f.last) > ll.Lockout && now.After(f.lockedUntil) {
+			delete(ll.failures, k)
+		}
+	}
+}
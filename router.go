@@ -0,0 +1,131 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"sort"
+	"strings"
+)
+
+// Middleware wraps a handler with behaviour shared by every route
+type Middleware func(http.Handler) http.Handler
+
+type paramsKey struct{}
+
+// PathParam returns the value of the {name} segment of the matched route
+func PathParam(r *http.Request, name string) string {
+	params, _ := r.Context().Value(paramsKey{}).(map[string]string)
+	return params[name]
+}
+
+type route struct {
+	pattern  string
+	method   string
+	segments []string
+	role     string
+	handler  http.HandlerFunc
+}
+
+// match reports whether the path fits the route, returning the values of
+// its {param} segments
+func (rt *route) match(segments []string) (map[string]string, bool) {
+	if len(segments) != len(rt.segments) {
+		return nil, false
+	}
+	params := map[string]string{}
+	for i, s := range rt.segments {
+		if strings.HasPrefix(s, "{") && strings.HasSuffix(s, "}") {
+			if segments[i] == "" {
+				return nil, false
+			}
+			params[s[1:len(s)-1]] = segments[i]
+			continue
+		}
+		if s != segments[i] {
+			return nil, false
+		}
+	}
+	return params, true
+}
+
+// Router dispatches on method and path patterns like /api/games/{gameID},
+// answering 404 and 405 itself
+type Router struct {
+	routes     []*route
+	middleware []Middleware
+}
+
+func splitPath(p string) []string {
+	return strings.Split(strings.Trim(p, "/"), "/")
+}
+
+// Handle adds a route, role is the minimum role needed to call it ("" for anyone)
+func (rr *Router) Handle(method, pattern, role string, h http.HandlerFunc) {
+	rr.routes = append(rr.routes, &route{
+		pattern:  pattern,
+		method:   method,
+		segments: splitPath(pattern),
+		role:     role,
+		handler:  h,
+	})
+}
+
+// Use wraps every request the router sees, the first middleware added is the outermost
+func (rr *Router) Use(mw ...Middleware) {
+	rr.middleware = append(rr.middleware, mw...)
+}
+
+// Methods lists the methods routed for the path, sorted
+func (rr *Router) Methods(path string) []string {
+	segments := splitPath(path)
+	methods := []string{}
+	for _, rt := range rr.routes {
+		if _, ok := rt.match(segments); ok {
+			methods = append(methods, rt.method)
+		}
+	}
+	sort.Strings(methods)
+	return methods
+}
+
+func (rr *Router) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	var h http.Handler = http.HandlerFunc(rr.dispatch)
+	for i := len(rr.middleware) - 1; i >= 0; i-- {
+		h = rr.middleware[i](h)
+	}
+	h.ServeHTTP(w, r)
+}
+
+func (rr *Router) dispatch(w http.ResponseWriter, r *http.Request) {
+	segments := splitPath(r.URL.Path)
+	allowed := []string{}
+	for _, rt := range rr.routes {
+		params, ok := rt.match(segments)
+		if !ok {
+			continue
+		}
+		if rt.method != r.Method {
+			allowed = append(allowed, rt.method)
+			continue
+		}
+		setRoute(r, rt.pattern)
+		ctx := context.WithValue(r.Context(), paramsKey{}, params)
+		if rt.role != "" && !hasRole(ctx, rt.role) {
+			if playerID, _ := ctx.Value("playerID").(string); playerID == "" {
+				WriteError(w, NewAPIError(http.StatusUnauthorized, CodeUnauthorized, "Unauthorized"))
+			} else {
+				WriteError(w, NewAPIError(http.StatusForbidden, CodeForbidden, "Forbidden"))
+			}
+			return
+		}
+		rt.handler(w, r.WithContext(ctx))
+		return
+	}
+	if len(allowed) == 0 {
+		WriteError(w, NewAPIError(http.StatusNotFound, CodeNotFound, "Not Found"))
+		return
+	}
+	sort.Strings(allowed)
+	w.Header().Set("Allow", strings.Join(allowed, ", "))
+	WriteError(w, NewAPIError(http.StatusMethodNotAllowed, CodeMethodNotAllowed, "Method Not Allowed"))
+}
@@ -0,0 +1,30 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+)
+
+func (ah *APIHandler) GetSessionsHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	playerID, _ := r.Context().Value("playerID").(string)
+	currentID, _ := r.Context().Value("sessionID").(string)
+
+	sessions := ah.Sessions.ForPlayer(playerID)
+	for i := range sessions {
+		sessions[i].TokenHash = ""
+		sessions[i].Current = sessions[i].ID == currentID
+	}
+	e := json.NewEncoder(w)
+	e.Encode(&sessions)
+}
+
+func (ah *APIHandler) DeleteSessionHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	playerID, _ := r.Context().Value("playerID").(string)
+	if !ah.Sessions.Revoke(playerID, PathParam(r, "sessionID")) {
+		WriteError(w, NewAPIError(http.StatusNotFound, CodeNotFound, "Not Found"))
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
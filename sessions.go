@@ -0,0 +1,212 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Session ties a bearer token or shsid cookie to a player until it expires.
+// Only a hash of the token is kept so persisted sessions can't be replayed.
+type Session struct {
+	ID         string    `json:"id"`
+	TokenHash  string    `json:"tokenHash,omitempty"`
+	PlayerID   string    `json:"playerId"`
+	Role       string    `json:"role"`
+	CreatedAt  time.Time `json:"createdAt"`
+	LastSeen   time.Time `json:"lastSeen"`
+	ExpiresAt  time.Time `json:"expiresAt"`
+	UserAgent  string    `json:"userAgent"`
+	RemoteAddr string    `json:"remoteAddr"`
+	Current    bool      `json:"current,omitempty"`
+}
+
+// SessionStore keeps the live sessions in memory, renewing them each time
+// they are used, and optionally persists them through a Store
+type SessionStore struct {
+	TTL   time.Duration
+	Store Store
+
+	sessions map[string]*Session
+	m        sync.Mutex
+}
+
+// NewSessionStore creates a session store, loading any sessions persisted
+// in store. Pass a nil store to keep sessions in memory only.
+func NewSessionStore(ttl time.Duration, store Store) (*SessionStore, error) {
+	ss := &SessionStore{
+		TTL:      ttl,
+		Store:    store,
+		sessions: make(map[string]*Session),
+	}
+	if store == nil {
+		return ss, nil
+	}
+	sessions, err := store.Sessions()
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	for _, s := range sessions {
+		if now.After(s.ExpiresAt) {
+			store.DeleteSession(s.ID)
+			continue
+		}
+		ss.sessions[s.TokenHash] = s
+	}
+	return ss, nil
+}
+
+func hashToken(token string) string {
+	h := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(h[:])
+}
+
+// Create starts a new session for the player, returning the token for it
+func (ss *SessionStore) Create(playerID, role string, r *http.Request) (string, *Session, error) {
+	token := GenUUIDv4()
+	now := time.Now()
+	s := &Session{
+		ID:         GenUUIDv4(),
+		TokenHash:  hashToken(token),
+		PlayerID:   playerID,
+		Role:       role,
+		CreatedAt:  now,
+		LastSeen:   now,
+		ExpiresAt:  now.Add(ss.TTL),
+		UserAgent:  r.UserAgent(),
+		RemoteAddr: r.RemoteAddr,
+	}
+	if ss.Store != nil {
+		if err := ss.Store.PutSession(s); err != nil {
+			return "", nil, err
+		}
+	}
+	ss.m.Lock()
+	ss.sessions[s.TokenHash] = s
+	ss.m.Unlock()
+	return token, s, nil
+}
+
+// Get finds the unexpired session for the token and slides its expiry forward
+func (ss *SessionStore) Get(token string) (*Session, bool) {
+	if token == "" {
+		return nil, false
+	}
+	ss.m.Lock()
+	defer ss.m.Unlock()
+	s, ok := ss.sessions[hashToken(token)]
+	if !ok {
+		return nil, false
+	}
+	now := time.Now()
+	if now.After(s.ExpiresAt) {
+		ss.remove(s)
+		return nil, false
+	}
+	//Only write renewals through every so often, not on every request
+	persist := now.Sub(s.LastSeen) > time.Minute
+	s.LastSeen = now
+	s.ExpiresAt = now.Add(ss.TTL)
+	if persist && ss.Store != nil {
+		if err := ss.Store.PutSession(s); err != nil {
+			logger.Error("store session", "sessionID", s.ID, "err", err)
+		}
+	}
+	ret := *s
+	return &ret, true
+}
+
+// Delete ends the session for the token
+func (ss *SessionStore) Delete(token string) {
+	ss.m.Lock()
+	defer ss.m.Unlock()
+	if s, ok := ss.sessions[hashToken(token)]; ok {
+		ss.remove(s)
+	}
+}
+
+// ForPlayer lists the sessions the player has open
+func (ss *SessionStore) ForPlayer(playerID string) []Session {
+	ss.m.Lock()
+	defer ss.m.Unlock()
+	ret := []Session{}
+	now := time.Now()
+	for _, s := range ss.sessions {
+		if s.PlayerID == playerID && now.Before(s.ExpiresAt) {
+			ret = append(ret, *s)
+		}
+	}
+	return ret
+}
+
+// Revoke ends the session with the id, as long as it belongs to the player
+func (ss *SessionStore) Revoke(playerID, sessionID string) bool {
+	ss.m.Lock()
+	defer ss.m.Unlock()
+	for _, s := range ss.sessions {
+		if s.ID == sessionID && s.PlayerID == playerID {
+			ss.remove(s)
+			return true
+		}
+	}
+	return false
+}
+
+// RevokeAll ends every session of the player except the one with exceptID
+func (ss *SessionStore) RevokeAll(playerID, exceptID string) {
+	ss.m.Lock()
+	defer ss.m.Unlock()
+	for _, s := range ss.sessions {
+		if s.PlayerID == playerID && s.ID != exceptID {
+			ss.remove(s)
+		}
+	}
+}
+
+// SetRole changes the role of every session the player has open
+func (ss *SessionStore) SetRole(playerID, role string) {
+	ss.m.Lock()
+	defer ss.m.Unlock()
+	for _, s := range ss.sessions {
+		if s.PlayerID != playerID {
+			continue
+		}
+		s.Role = role
+		if ss.Store != nil {
+			if err := ss.Store.PutSession(s); err != nil {
+				logger.Error("store session", "sessionID", s.ID, "err", err)
+			}
+		}
+	}
+}
+
+// Len is how many sessions are logged in
+func (ss *SessionStore) Len() int {
+	ss.m.Lock()
+	defer ss.m.Unlock()
+	return len(ss.sessions)
+}
+
+// Prune drops every expired session
+func (ss *SessionStore) Prune() {
+	ss.m.Lock()
+	defer ss.m.Unlock()
+	now := time.Now()
+	for _, s := range ss.sessions {
+		if now.After(s.ExpiresAt) {
+			ss.remove(s)
+		}
+	}
+}
+
+func (ss *SessionStore) remove(s *Session) {
+	delete(ss.sessions, s.TokenHash)
+	if ss.Store != nil {
+		if err := ss.Store.DeleteSession(s.ID); err != nil {
+			logger.Error("store session", "sessionID", s.ID, "err", err)
+		}
+	}
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"errors"
+	"io"
+)
+
+var (
+	ErrNotFound = errors.New("Not Found")
+)
+
+// Store persists players, game metadata and the append only game event logs
+type Store interface {
+	GetPlayer(id string) (*Player, error)
+	//FindPlayerByEmail ignores case and surrounding space
+	FindPlayerByEmail(email string) (*Player, error)
+	PutPlayer(p *Player) error
+	DeletePlayer(id string) error
+
+	Sessions() ([]*Session, error)
+	PutSession(s *Session) error
+	DeleteSession(id string) error
+
+	GetGameMeta(gameID string) (*GameMeta, error)
+	PutGameMeta(m *GameMeta) error
+
+	//GameIDs lists every game that has an event log
+	GameIDs() ([]string, error)
+	//EventLog returns a writer that appends to the log of the game
+	EventLog(gameID string) io.Writer
+	//OpenEventLog reads the log of the game, skipping the first offset events
+	OpenEventLog(gameID string, offset int) (io.ReadCloser, error)
+	//RewriteEventLog replaces every line of a log with the result of fn,
+	//only for games that are no longer being written to
+	RewriteEventLog(gameID string, fn func(line []byte) []byte) error
+
+	//Sync flushes everything written so far to disk
+	Sync() error
+	//Ping checks the store can still be written to
+	Ping() error
+	Close() error
+}
+
+// OpenStore opens the storage backend named by kind, keeping its data in dir
+func OpenStore(kind, dir string) (Store, error) {
+	switch kind {
+	case "file", "":
+		return NewFileStore(dir)
+	case "bolt":
+		return NewBoltStore(dir)
+	}
+	return nil, errors.New("unknown store: " + kind)
+}
@@ -0,0 +1,423 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/websocket"
+	sh "github.com/murphysean/secrethitler"
+)
+
+// State modes for the event stream: no state frames, the whole state after
+// each change, or a JSON Patch against the last state sent
+const (
+	stateNone = "none"
+	stateFull = "full"
+	stateDiff = "diff"
+)
+
+// Limits and defaults for the event stream query options
+const (
+	defaultKeepalive = time.Minute
+	minKeepalive     = time.Second
+	maxKeepalive     = 10 * time.Minute
+	defaultRetry     = 3 * time.Second
+	maxRetry         = 5 * time.Minute
+)
+
+// streamOptions are the query options of an event stream
+type streamOptions struct {
+	//Keepalive is how often an idle stream gets a comment to keep it open
+	Keepalive time.Duration
+	//Retry is how long the client should wait before reconnecting
+	Retry time.Duration
+	//State is the state mode
+	State string
+}
+
+// parseStreamOptions reads ?keepalive=, ?retry=, and ?state= or the older
+// ?includeState=, with state beating includeState
+func parseStreamOptions(r *http.Request) (streamOptions, error) {
+	q := r.URL.Query()
+	opts := streamOptions{Keepalive: defaultKeepalive, Retry: defaultRetry, State: stateFull}
+	if v := q.Get("keepalive"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil || d < minKeepalive || d > maxKeepalive {
+			return opts, &FieldError{Field: "keepalive", Message: "must be a duration from 1s to 10m"}
+		}
+		opts.Keepalive = d
+	}
+	if v := q.Get("retry"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil || d < 0 || d > maxRetry {
+			return opts, &FieldError{Field: "retry", Message: "must be a duration up to 5m"}
+		}
+		opts.Retry = d
+	}
+	if v := q.Get("includeState"); v != "" {
+		include, err := strconv.ParseBool(v)
+		if err != nil {
+			return opts, &FieldError{Field: "includeState", Message: "must be true or false"}
+		}
+		if !include {
+			opts.State = stateNone
+		}
+	}
+	switch v := q.Get("state"); v {
+	case "":
+	case stateNone, stateFull, stateDiff:
+		opts.State = v
+	default:
+		return opts, &FieldError{Field: "state", Message: "must be none, full or diff"}
+	}
+	return opts, nil
+}
+
+// streamClosedID is the id of the server.close frame, past any real event so
+// a client reconnecting with it is told the game is over
+const streamClosedID = 1000000000
+
+// streamFrame is one message of a game stream, an event on the event stream
+// or a message on a game socket. Ref ties an ack or error to the client
+// message it answers, Retry tells an event stream how long to wait before
+// reconnecting.
+type streamFrame struct {
+	ID    int         `json:"id,omitempty"`
+	Event string      `json:"event"`
+	Ref   string      `json:"ref,omitempty"`
+	Retry int64       `json:"-"`
+	Data  interface{} `json:"data"`
+}
+
+// frameWriter puts frames on the wire for one transport
+type frameWriter interface {
+	WriteFrame(f streamFrame) error
+	Flush() error
+}
+
+// sseWriter writes frames as server sent events
+type sseWriter struct {
+	w io.Writer
+	f http.Flusher
+}
+
+func (sw sseWriter) WriteFrame(f streamFrame) error {
+	b, err := json.Marshal(f.Data)
+	if err != nil {
+		return err
+	}
+	buf := bytes.Buffer{}
+	if f.Retry > 0 {
+		fmt.Fprintf(&buf, "retry: %d\n", f.Retry)
+	}
+	if f.ID > 0 {
+		fmt.Fprintf(&buf, "id: %d\n", f.ID)
+	}
+	fmt.Fprintf(&buf, "event: %s\n", f.Event)
+	fmt.Fprintf(&buf, "data: %s\n\n", b)
+	_, err = sw.w.Write(buf.Bytes())
+	return err
+}
+
+// Comment writes a line the client ignores, to keep the connection open
+func (sw sseWriter) Comment(c string) error {
+	_, err := fmt.Fprintf(sw.w, ": %s\n\n", c)
+	return err
+}
+
+// Retry tells the client how long to wait before reconnecting, without
+// sending an event
+func (sw sseWriter) Retry(d time.Duration) error {
+	_, err := fmt.Fprintf(sw.w, "retry: %d\n\n", int64(d/time.Millisecond))
+	return err
+}
+
+func (sw sseWriter) Flush() error {
+	sw.f.Flush()
+	return nil
+}
+
+// wsWriter writes frames as json websocket messages
+type wsWriter struct {
+	conn *websocket.Conn
+}
+
+func (ww wsWriter) WriteFrame(f streamFrame) error {
+	ww.conn.SetWriteDeadline(time.Now().Add(wsWriteWait))
+	return ww.conn.WriteJSON(&f)
+}
+
+func (ww wsWriter) Flush() error {
+	return nil
+}
+
+// streamEncoder turns a game into frames, the same way for events replayed
+// from the log as for events from the live game
+type streamEncoder struct {
+	ah     *APIHandler
+	r      *http.Request
+	gameID string
+	meta   GameMeta
+	//Filter events and state for the player, unless the game was over before
+	//the stream started
+	filter bool
+	//state is the state mode, and prevState the last state sent for diffs
+	state     string
+	prevState interface{}
+	//last is the id of the last event sent or applied, so live events replay
+	//already covered aren't sent twice
+	last int
+	//game is the state after the last event applied, built from the log and
+	//then the live events
+	game sh.Game
+	w    frameWriter
+}
+
+func (ah *APIHandler) newStreamEncoder(r *http.Request, gameID string, filter bool, w frameWriter) *streamEncoder {
+	return &streamEncoder{
+		ah:     ah,
+		r:      r,
+		gameID: gameID,
+		meta:   ah.gameMeta(gameID),
+		filter: filter,
+		state:  stateFull,
+		w:      w,
+	}
+}
+
+// shouldSendState is whether an event changes the game enough to be followed
+// by a state frame
+func shouldSendState(t string) bool {
+	if strings.HasPrefix(t, "request.") {
+		return false
+	}
+	if strings.HasPrefix(t, "react.") {
+		return false
+	}
+	if t == sh.TypeGameInformation {
+		return false
+	}
+	if t == sh.TypePlayerVote {
+		return false
+	}
+	if t == sh.TypePlayerMessage {
+		return false
+	}
+	if t == sh.TypeGuess {
+		return false
+	}
+	return true
+}
+
+// playerJSON is the profile of a player for player frames, made up from the
+// id when the player isn't in the store
+func (ah *APIHandler) playerJSON(ctx context.Context, playerID string) json.RawMessage {
+	p, err := ah.GetPlayer(ctx, playerID)
+	if err != nil {
+		p = &Player{
+			ID:           playerID,
+			Email:        playerID,
+			Name:         playerID,
+			Username:     playerID,
+			ThumbnailURL: "http://www.gravatar.com/avatar",
+		}
+	}
+	p.PasswordHash = ""
+	b, _ := json.Marshal(p)
+	return b
+}
+
+// Players sends the profile of everyone in the game, so the client can show
+// them before any events arrive
+func (se *streamEncoder) Players(g sh.Game) error {
+	for _, p := range g.Players {
+		if err := se.w.WriteFrame(streamFrame{Event: "player", Data: se.ah.playerJSON(se.r.Context(), p.ID)}); err != nil {
+			return err
+		}
+	}
+	return se.w.Flush()
+}
+
+// Event sends an event, preceded by the joining player's profile for joins
+// and followed by the game state g after the event when it changed the game
+func (se *streamEncoder) Event(e sh.Event, g sh.Game) error {
+	ctx := se.r.Context()
+	if e.GetType() == sh.TypePlayerJoin {
+		if pje, ok := e.(sh.PlayerEvent); ok {
+			if err := se.w.WriteFrame(streamFrame{ID: e.GetID(), Event: "player", Data: se.ah.playerJSON(ctx, pje.Player.ID)}); err != nil {
+				return err
+			}
+		}
+	}
+	if se.filter {
+		e = e.Filter(ctx)
+	}
+	if err := se.w.WriteFrame(streamFrame{ID: e.GetID(), Event: e.GetType(), Data: e}); err != nil {
+		return err
+	}
+	se.last = e.GetID()
+	if se.state != stateNone && shouldSendState(e.GetType()) {
+		if se.filter {
+			g = g.Filter(ctx)
+		}
+		if err := se.writeState(e.GetID(), GameFromGame(g, se.meta)); err != nil {
+			return err
+		}
+	}
+	return se.w.Flush()
+}
+
+// writeState sends a state frame, or in diff mode a state.diff frame patching
+// the last state sent. The first state is always sent whole.
+func (se *streamEncoder) writeState(id int, state interface{}) error {
+	if se.state != stateDiff {
+		return se.w.WriteFrame(streamFrame{ID: id, Event: "state", Data: state})
+	}
+	doc, err := jsonValue(state)
+	if err != nil {
+		return err
+	}
+	prev := se.prevState
+	se.prevState = doc
+	if prev == nil {
+		return se.w.WriteFrame(streamFrame{ID: id, Event: "state", Data: state})
+	}
+	patch := jsonDiff(prev, doc)
+	if len(patch) == 0 {
+		return nil
+	}
+	return se.w.WriteFrame(streamFrame{ID: id, Event: "state.diff", Data: patch})
+}
+
+// Replay sends the events in the log after lastEventID, up to and including
+// upTo, with the state as it was after each of them. Live carries on from
+// the state after upTo.
+func (se *streamEncoder) Replay(lastEventID, upTo int) error {
+	se.last = lastEventID
+	return se.readLog(lastEventID, upTo, se.Event)
+}
+
+// readLog applies the events in the log up to and including upTo to a new
+// game, passing those after after to each. The encoder's game ends up as the
+// state after upTo, so live events build on it the same way replay does.
+func (se *streamEncoder) readLog(after, upTo int, each func(e sh.Event, g sh.Game) error) error {
+	f, err := se.ah.Store.OpenEventLog(se.gameID, 0)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	events := make(chan sh.Event)
+	go func() {
+		if err := sh.ReadEventLog(f, events); err != nil && err != io.EOF {
+			se.ah.logger(se.r).Error("read event log", "err", err)
+		}
+	}()
+	//Let the log reader finish if the client goes away part way through
+	defer func() {
+		for range events {
+		}
+	}()
+	se.game = sh.Game{}
+	for e := range events {
+		if e.GetID() > upTo {
+			continue
+		}
+		if se.game, _, err = se.game.Apply(e); err != nil {
+			se.ah.logger(se.r).Warn("replay event", "eventId", e.GetID(), "err", err)
+		}
+		if e.GetID() > se.last {
+			se.last = e.GetID()
+		}
+		if each == nil || e.GetID() <= after {
+			continue
+		}
+		if err := each(e, se.game); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Live applies an event from the game to the encoder's copy of it and sends
+// it with the state after it, unless replay already covered it. The state
+// comes from the same events in the same order as in Replay, never from the
+// live game, so both send the same frames.
+func (se *streamEncoder) Live(e sh.Event) error {
+	if e.GetID() <= se.last {
+		return nil
+	}
+	var err error
+	if se.game, _, err = se.game.Apply(e); err != nil {
+		se.ah.logger(se.r).Warn("apply live event", "eventId", e.GetID(), "err", err)
+	}
+	return se.Event(e, se.game)
+}
+
+// Finished is whether the game is over as of the last event applied
+func (se *streamEncoder) Finished() bool {
+	return se.game.State == sh.GameStateFinished
+}
+
+// Resync tells a client that fell behind how many events it missed, then
+// sends the whole game state to start over from, unless it asked for no
+// state. The state is a copy of the live game, so the game is only held for
+// as long as copying it takes, and queued events it already covers are
+// skipped.
+func (se *streamEncoder) Resync(ret *sh.SecretHitler, dropped int) error {
+	//A deep copy, through the json the log keeps games as, since live events
+	//are applied to it and it mustn't share anything with the real game.
+	//Encoding it is all that happens under the game's lock.
+	l := se.ah.gameLock(se.gameID)
+	l.Lock()
+	b, err := json.Marshal(ret.Game)
+	l.Unlock()
+	if err != nil {
+		return err
+	}
+	g := sh.Game{}
+	if err := json.Unmarshal(b, &g); err != nil {
+		return err
+	}
+	se.game = g
+	se.last = g.EventID
+	id := se.last
+	if err := se.w.WriteFrame(streamFrame{ID: id, Event: "stream.resync", Data: map[string]int{"dropped": dropped, "eventId": id}}); err != nil {
+		return err
+	}
+	if se.state != stateNone {
+		g := se.game
+		if se.filter {
+			g = g.Filter(se.r.Context())
+		}
+		//Diffs start over from this state
+		se.prevState = nil
+		if err := se.writeState(id, GameFromGame(g, se.meta)); err != nil {
+			return err
+		}
+	}
+	return se.w.Flush()
+}
+
+// Close tells the client the game is over and there is nothing more to come
+func (se *streamEncoder) Close() error {
+	if err := se.w.WriteFrame(streamFrame{ID: streamClosedID, Event: "server.close", Data: struct{}{}}); err != nil {
+		return err
+	}
+	return se.w.Flush()
+}
+
+// Restart tells the client to come back once the server is up again
+func (se *streamEncoder) Restart() error {
+	retry := int64(se.ah.Config.RestartRetry / time.Millisecond)
+	if err := se.w.WriteFrame(streamFrame{Event: "server.restart", Retry: retry, Data: map[string]int64{"retry": retry}}); err != nil {
+		return err
+	}
+	return se.w.Flush()
+}
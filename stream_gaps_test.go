@@ -0,0 +1,299 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// TestStreamsHaveNoGaps floods a game with events from several players while
+// clients keep dropping and resuming the event stream with Last-Event-Id,
+// then checks every client saw every event exactly once and in order.
+func TestStreamsHaveNoGaps(t *testing.T) {
+	if testing.Short() {
+		t.Skip("floods a game with events")
+	}
+	dir, err := ioutil.TempDir("", "streamgaps")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	store, err := NewFileStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ah := NewAPIHandler(&Config{TestingMode: true, StreamBuffer: 16}, store, nil, nil, nil)
+	ah.Log = NewLogger(ioutil.Discard, LevelError)
+	srv := httptest.NewServer(ah)
+	defer srv.Close()
+	defer ah.Shutdown()
+
+	const players, events, clients, maxFrames = 4, 50, 6, 25
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	gameID, err := createCheckGame(srv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < players; i++ {
+		pid := "p" + strconv.Itoa(i)
+		if err := submitCheckEvent(srv.URL, gameID, pid, map[string]interface{}{"type": "player.join", "player": map[string]string{"id": pid}}); err != nil {
+			t.Fatalf("join %s: %v", pid, err)
+		}
+	}
+
+	//Clients start following before the flood, and keep reconnecting through it
+	done := make(chan struct{})
+	results := make([][]checkFrame, clients)
+	cwg := sync.WaitGroup{}
+	for i := 0; i < clients; i++ {
+		cwg.Add(1)
+		go func(i int) {
+			defer cwg.Done()
+			results[i] = followStream(ctx, srv.URL, gameID, "c"+strconv.Itoa(i), maxFrames, done)
+		}(i)
+	}
+
+	errs := make(chan error, players)
+	swg := sync.WaitGroup{}
+	for i := 0; i < players; i++ {
+		swg.Add(1)
+		go func(pid string) {
+			defer swg.Done()
+			for n := 0; n < events; n++ {
+				err := submitCheckEvent(srv.URL, gameID, pid, map[string]interface{}{"type": "player.message", "playerId": pid, "message": strconv.Itoa(n)})
+				if err != nil {
+					errs <- fmt.Errorf("submit %s %d: %v", pid, n, err)
+					return
+				}
+			}
+		}("p" + strconv.Itoa(i))
+	}
+	swg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Fatal(err)
+	}
+
+	last, err := checkLastEventID(srv.URL, gameID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := 1 + players + players*events; last != want {
+		t.Fatalf("game ended at event %d, not %d", last, want)
+	}
+	//Give the clients until they've caught up to the last event
+	close(done)
+	cwg.Wait()
+	if ctx.Err() != nil {
+		t.Error("clients didn't catch up before the timeout")
+	}
+	for i, frames := range results {
+		if problems := checkFrames(frames, last); len(problems) > 0 {
+			t.Errorf("c%d: %s", i, strings.Join(problems, ", "))
+		}
+	}
+}
+
+// checkFrame is an event a client saw, or a resync that skipped it ahead to
+// the state after the event with that id
+type checkFrame struct {
+	ID     int
+	Resync bool
+}
+
+func createCheckGame(base string) (string, error) {
+	resp, err := http.Post(base+"/api/games/?name=check&playerID=host", "application/json", strings.NewReader("{}"))
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	g := struct {
+		ID string `json:"id"`
+	}{}
+	if err := json.NewDecoder(resp.Body).Decode(&g); err != nil {
+		return "", err
+	}
+	return g.ID, nil
+}
+
+func checkLastEventID(base, gameID string) (int, error) {
+	resp, err := http.Get(base + "/api/games/" + gameID + "?playerID=host")
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	g := struct {
+		EventID int `json:"eventId"`
+	}{}
+	err = json.NewDecoder(resp.Body).Decode(&g)
+	return g.EventID, err
+}
+
+func submitCheckEvent(base, gameID, playerID string, e map[string]interface{}) error {
+	b, _ := json.Marshal(e)
+	resp, err := http.Post(base+"/api/games/"+gameID+"/events?playerID="+url.QueryEscape(playerID), "application/json", bytes.NewReader(b))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		body := new(bytes.Buffer)
+		body.ReadFrom(resp.Body)
+		return fmt.Errorf("%s: %s", resp.Status, strings.TrimSpace(body.String()))
+	}
+	return nil
+}
+
+// followStream reads the event stream a few events at a time, reconnecting
+// with the last id it saw, until done is closed and it has caught up
+func followStream(ctx context.Context, base, gameID, playerID string, maxFrames int, done chan struct{}) []checkFrame {
+	frames := []checkFrame{}
+	leid := 0
+	target := -1
+	for ctx.Err() == nil {
+		select {
+		case <-done:
+			if target < 0 {
+				target, _ = checkLastEventID(base, gameID)
+			}
+		default:
+		}
+		if target >= 0 && leid >= target {
+			return frames
+		}
+		n := 1 + rand.Intn(maxFrames)
+		//Once done, read until caught up rather than dropping again
+		if target >= 0 {
+			n = -1
+		}
+		got, _ := readStream(ctx, base, gameID, playerID, leid, n, target, done)
+		frames = append(frames, got...)
+		if len(got) > 0 {
+			leid = got[len(got)-1].ID
+		}
+	}
+	return frames
+}
+
+// readStream connects once, returning the events read. It hangs up after n
+// events, or once it reaches the target when n is negative. Waiting for n
+// events ends when done is closed, since no more may come.
+func readStream(ctx context.Context, base, gameID, playerID string, leid, n, target int, done chan struct{}) ([]checkFrame, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	if n > 0 {
+		go func() {
+			select {
+			case <-done:
+				cancel()
+			case <-ctx.Done():
+			}
+		}()
+	}
+	req, _ := http.NewRequest(http.MethodGet, base+"/api/games/"+gameID+"/events?playerID="+url.QueryEscape(playerID), nil)
+	req = req.WithContext(ctx)
+	if leid > 0 {
+		req.Header.Set("Last-Event-Id", strconv.Itoa(leid))
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%s", resp.Status)
+	}
+
+	frames := []checkFrame{}
+	id, event := 0, ""
+	s := bufio.NewScanner(resp.Body)
+	s.Buffer(make([]byte, 64*1024), 1024*1024)
+	for s.Scan() {
+		line := s.Text()
+		switch {
+		case strings.HasPrefix(line, "id: "):
+			id, _ = strconv.Atoi(line[4:])
+		case strings.HasPrefix(line, "event: "):
+			event = line[7:]
+		case line == "":
+			//Player profiles and states share the id of their event
+			if event != "" && event != "player" && event != "state" && event != "state.diff" && !strings.HasPrefix(event, "server.") {
+				frames = append(frames, checkFrame{ID: id, Resync: event == "stream.resync"})
+				if n > 0 && len(frames) >= n {
+					return frames, nil
+				}
+				if n < 0 && id >= target {
+					return frames, nil
+				}
+			}
+			id, event = 0, ""
+		}
+	}
+	return frames, s.Err()
+}
+
+// checkFrames looks for gaps, repeats and reordering in the events a client
+// saw. Only a resync may skip ahead.
+func checkFrames(frames []checkFrame, last int) []string {
+	problems := []string{}
+	if len(frames) == 0 {
+		return []string{"no events"}
+	}
+	seen := map[int]bool{}
+	prev := 0
+	for i, f := range frames {
+		if f.Resync {
+			if i > 0 && f.ID < prev {
+				problems = append(problems, fmt.Sprintf("resync to %d after %d", f.ID, prev))
+			}
+			prev = f.ID
+			continue
+		}
+		if seen[f.ID] {
+			problems = append(problems, fmt.Sprintf("event %d twice", f.ID))
+		}
+		seen[f.ID] = true
+		if i > 0 && f.ID != prev+1 {
+			problems = append(problems, fmt.Sprintf("%d after %d", f.ID, prev))
+		}
+		prev = f.ID
+	}
+	if prev != last {
+		problems = append(problems, fmt.Sprintf("ended at %d not %d", prev, last))
+	}
+	return problems
+}
+
+func TestCheckFrames(t *testing.T) {
+	tests := []struct {
+		frames []checkFrame
+		ok     bool
+	}{
+		{[]checkFrame{{ID: 1}, {ID: 2}, {ID: 3}}, true},
+		{[]checkFrame{{ID: 1}, {ID: 3}}, false},
+		{[]checkFrame{{ID: 1}, {ID: 2}, {ID: 2}, {ID: 3}}, false},
+		{[]checkFrame{{ID: 1}, {ID: 3, Resync: true}}, true},
+		{[]checkFrame{{ID: 2}, {ID: 1, Resync: true}, {ID: 2}, {ID: 3}}, false},
+		{[]checkFrame{{ID: 1}, {ID: 2}}, false},
+	}
+	for i, test := range tests {
+		if problems := checkFrames(test.frames, 3); (len(problems) == 0) != test.ok {
+			t.Errorf("%d: %v", i, problems)
+		}
+	}
+}
@@ -0,0 +1,198 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+
+	sh "github.com/murphysean/secrethitler"
+)
+
+// bufferWriter collects the frames of a stream as event stream text
+type bufferWriter struct {
+	bytes.Buffer
+}
+
+func (bw *bufferWriter) WriteFrame(f streamFrame) error {
+	return sseWriter{w: &bw.Buffer}.WriteFrame(f)
+}
+
+func (bw *bufferWriter) Flush() error {
+	return nil
+}
+
+// streamFixture is a handler with one game whose log holds events, in a data
+// directory the caller removes
+func streamFixture(t *testing.T) (*APIHandler, string, []sh.Event, string) {
+	dir, err := ioutil.TempDir("", "stream")
+	if err != nil {
+		t.Fatal(err)
+	}
+	store, err := NewFileStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg := &Config{StreamBuffer: 16}
+	ah := NewAPIHandler(cfg, store, nil, nil, nil)
+	ah.Log = NewLogger(ioutil.Discard, LevelError)
+
+	gameID := "3a37480d-5f65-433c-8f0d-82a3af1f5b59"
+	events := []sh.Event{
+		sh.GameEvent{BaseEvent: sh.BaseEvent{ID: 1, Type: sh.TypeGameUpdate}, Game: sh.Game{ID: gameID}},
+		sh.PlayerEvent{BaseEvent: sh.BaseEvent{ID: 2, Type: sh.TypePlayerJoin}, Player: sh.Player{ID: "a"}},
+		sh.PlayerEvent{BaseEvent: sh.BaseEvent{ID: 3, Type: sh.TypePlayerJoin}, Player: sh.Player{ID: "b"}},
+		sh.PlayerEvent{BaseEvent: sh.BaseEvent{ID: 4, Type: sh.TypePlayerJoin}, Player: sh.Player{ID: "c"}},
+		sh.PlayerEvent{BaseEvent: sh.BaseEvent{ID: 5, Type: sh.TypePlayerJoin}, Player: sh.Player{ID: "d"}},
+	}
+	log := store.EventLog(gameID)
+	for _, e := range events {
+		b, err := json.Marshal(e)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := log.Write(append(b, '\n')); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return ah, gameID, events, dir
+}
+
+func streamRequest(playerID string) *http.Request {
+	r := httptest.NewRequest(http.MethodGet, "/api/games/x/events", nil)
+	return r.WithContext(context.WithValue(r.Context(), "playerID", playerID))
+}
+
+func TestStreamReplayMatchesLive(t *testing.T) {
+	ah, gameID, events, dir := streamFixture(t)
+	defer os.RemoveAll(dir)
+	for _, state := range []string{stateFull, stateDiff, stateNone} {
+		//The whole game from the log
+		replayed := &bufferWriter{}
+		se := ah.newStreamEncoder(streamRequest("a"), gameID, true, replayed)
+		se.state = state
+		if err := se.Replay(0, len(events)); err != nil {
+			t.Fatal(err)
+		}
+
+		//The same game watched from before it started
+		live := &bufferWriter{}
+		se = ah.newStreamEncoder(streamRequest("a"), gameID, true, live)
+		se.state = state
+		if err := se.Replay(0, 0); err != nil {
+			t.Fatal(err)
+		}
+		for _, e := range events {
+			if err := se.Live(e); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		//And joined part way through, with the subscription repeating
+		//events the replay already sent
+		handoff := &bufferWriter{}
+		se = ah.newStreamEncoder(streamRequest("a"), gameID, true, handoff)
+		se.state = state
+		if err := se.Replay(0, 3); err != nil {
+			t.Fatal(err)
+		}
+		for _, e := range events[1:] {
+			if err := se.Live(e); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		if replayed.Len() == 0 {
+			t.Fatalf("%s: replay sent nothing", state)
+		}
+		if live.String() != replayed.String() {
+			t.Errorf("%s: live differs from replay\nlive:\n%s\nreplay:\n%s", state, live.String(), replayed.String())
+		}
+		if handoff.String() != replayed.String() {
+			t.Errorf("%s: handoff differs from replay\nhandoff:\n%s\nreplay:\n%s", state, handoff.String(), replayed.String())
+		}
+	}
+}
+
+func TestStreamReplayFromLastEventID(t *testing.T) {
+	ah, gameID, events, dir := streamFixture(t)
+	defer os.RemoveAll(dir)
+
+	//A client reconnecting after event 3 gets the same frames for 4 and 5
+	//as one that saw the whole game
+	all := &bufferWriter{}
+	se := ah.newStreamEncoder(streamRequest("a"), gameID, true, all)
+	if err := se.Replay(0, 3); err != nil {
+		t.Fatal(err)
+	}
+	all.Reset()
+	for _, e := range events {
+		if err := se.Live(e); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	resumed := &bufferWriter{}
+	se = ah.newStreamEncoder(streamRequest("a"), gameID, true, resumed)
+	if err := se.Replay(3, len(events)); err != nil {
+		t.Fatal(err)
+	}
+	if resumed.String() != all.String() {
+		t.Errorf("resumed stream differs\nresumed:\n%s\nwant:\n%s", resumed.String(), all.String())
+	}
+}
+
+func TestStreamResync(t *testing.T) {
+	ah, gameID, events, dir := streamFixture(t)
+	defer os.RemoveAll(dir)
+	ret := sh.NewSecretHitler()
+	for _, e := range events {
+		g, _, err := ret.Game.Apply(e)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ret.Game = g
+	}
+
+	//A client that fell behind after event 2 starts over from the live game
+	bw := &bufferWriter{}
+	se := ah.newStreamEncoder(streamRequest("a"), gameID, true, bw)
+	if err := se.Replay(0, 2); err != nil {
+		t.Fatal(err)
+	}
+	bw.Reset()
+	if err := se.Resync(ret, 3); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(bw.String(), "event: stream.resync\ndata: {\"dropped\":3,\"eventId\":5}") {
+		t.Fatalf("no resync to event 5:\n%s", bw.String())
+	}
+	if !strings.Contains(bw.String(), "event: state\n") {
+		t.Fatalf("no state after the resync:\n%s", bw.String())
+	}
+
+	//Events still queued from before it are covered already
+	bw.Reset()
+	if err := se.Live(events[4]); err != nil {
+		t.Fatal(err)
+	}
+	if bw.Len() != 0 {
+		t.Fatalf("event 5 sent again:\n%s", bw.String())
+	}
+	next := sh.PlayerEvent{BaseEvent: sh.BaseEvent{ID: 6, Type: sh.TypePlayerJoin}, Player: sh.Player{ID: "e"}}
+	if err := se.Live(next); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(bw.String(), "id: 6\nevent: player.join") {
+		t.Fatalf("event 6 not sent:\n%s", bw.String())
+	}
+	//The live game is left alone
+	if len(ret.Game.Players) != 4 {
+		t.Fatalf("live game changed to %d players", len(ret.Game.Players))
+	}
+}
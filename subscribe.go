@@ -0,0 +1,105 @@
+package main
+
+import (
+	sh "github.com/murphysean/secrethitler"
+)
+
+// Subscription is one client's feed of a game's live events. The engine
+// hands events to subscribers while holding the game, so they're queued here
+// and the game never waits on a slow client. A client that falls more than
+// the stream buffer behind loses what was queued and is sent on Resync
+// instead, to start over from the current state.
+type Subscription struct {
+	//Snapshot is the id of the last event applied when the subscription was
+	//made. Events up to it are in the log, later ones come on Events.
+	Snapshot int
+	//Events are the game's events after the snapshot, in order
+	Events <-chan sh.Event
+	//Resync gets the number of events dropped when the client fell behind.
+	//It comes before any event queued after the drop.
+	Resync <-chan int
+
+	ret          *sh.SecretHitler
+	uid          string
+	size         int
+	done         chan struct{}
+	metrics      *Metrics
+	transport    string
+	unsubscribed func()
+}
+
+// Subscribe registers for the live events of a game. It holds the game's
+// lock, which every submission holds too, so no event is half way through
+// SubmitEvent: everything up to the snapshot has been logged, and everything
+// after it is submitted once the subscriber is registered and so comes to the
+// subscription. Transport labels the dropped event metrics.
+func (ah *APIHandler) Subscribe(gameID string, ret *sh.SecretHitler, transport string) *Subscription {
+	in := make(chan sh.Event)
+	out := make(chan sh.Event)
+	resync := make(chan int)
+	s := &Subscription{
+		Events:    out,
+		Resync:    resync,
+		ret:       ret,
+		uid:       GenUUIDv4(),
+		size:      ah.Config.StreamBuffer,
+		done:      make(chan struct{}),
+		metrics:   ah.Metrics,
+		transport: transport,
+	}
+	go s.pump(in, out, resync)
+	l := ah.gameLock(gameID)
+	l.Lock()
+	ret.AddSubscriber(s.uid, in)
+	s.Snapshot = ret.Game.EventID
+	l.Unlock()
+	s.unsubscribed = ah.Metrics.Subscribe(gameID)
+	return s
+}
+
+// pump takes every event the engine sends straight away, holding up to size
+// of them until the client is ready for them
+func (s *Subscription) pump(in <-chan sh.Event, out chan<- sh.Event, resync chan<- int) {
+	var queue []sh.Event
+	dropped := 0
+	for {
+		//Only offer an event to the client when there is one waiting, and
+		//never ahead of a resync
+		var send chan<- sh.Event
+		var next sh.Event
+		var sendResync chan<- int
+		if dropped > 0 {
+			sendResync = resync
+		} else if len(queue) > 0 {
+			send = out
+			next = queue[0]
+		}
+		select {
+		case e := <-in:
+			//A nil from the engine ends the stream, so it is never dropped
+			if e != nil && len(queue) >= s.size {
+				//The client is too far behind to catch up event by event
+				dropped += len(queue) + 1
+				s.metrics.StreamDropped.WithLabelValues(s.transport).Add(float64(len(queue) + 1))
+				queue = nil
+				continue
+			}
+			queue = append(queue, e)
+		case send <- next:
+			queue = queue[1:]
+		case sendResync <- dropped:
+			s.metrics.StreamResyncs.WithLabelValues(s.transport).Inc()
+			dropped = 0
+		case <-s.done:
+			return
+		}
+	}
+}
+
+// Close unregisters from the game. The pump keeps draining until the engine
+// has let go, so an event in flight can't leave the game stuck.
+func (s *Subscription) Close() {
+	s.ret.RemoveSubscriber(s.uid)
+	close(s.done)
+	s.unsubscribed()
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"crypto/tls"
+	"net"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+)
+
+// certPollInterval is how often the cert files are checked for changes
+const certPollInterval = 10 * time.Second
+
+// CertReloader serves the certificate in a pair of files, loading it again
+// whenever either file changes so renewals don't need a restart
+type CertReloader struct {
+	CertFile string
+	KeyFile  string
+
+	m       sync.RWMutex
+	cert    *tls.Certificate
+	modTime time.Time
+}
+
+func NewCertReloader(certFile, keyFile string) (*CertReloader, error) {
+	cr := &CertReloader{CertFile: certFile, KeyFile: keyFile}
+	if _, err := cr.Reload(); err != nil {
+		return nil, err
+	}
+	return cr, nil
+}
+
+// latestModTime is the newest modification time of the two files
+func (cr *CertReloader) latestModTime() (time.Time, error) {
+	var latest time.Time
+	for _, name := range []string{cr.CertFile, cr.KeyFile} {
+		fi, err := os.Stat(name)
+		if err != nil {
+			return latest, err
+		}
+		if fi.ModTime().After(latest) {
+			latest = fi.ModTime()
+		}
+	}
+	return latest, nil
+}
+
+// Reload loads the pair again if it changed since the last load, a broken
+// pair (e.g. only the cert written so far) leaves the old one in place
+func (cr *CertReloader) Reload() (bool, error) {
+	modTime, err := cr.latestModTime()
+	if err != nil {
+		return false, err
+	}
+	cr.m.RLock()
+	changed := cr.cert == nil || !modTime.Equal(cr.modTime)
+	cr.m.RUnlock()
+	if !changed {
+		return false, nil
+	}
+	cert, err := tls.LoadX509KeyPair(cr.CertFile, cr.KeyFile)
+	if err != nil {
+		return false, err
+	}
+	cr.m.Lock()
+	cr.cert = &cert
+	cr.modTime = modTime
+	cr.m.Unlock()
+	return true, nil
+}
+
+// Watch reloads the pair every interval until stop is closed
+func (cr *CertReloader) Watch(interval time.Duration, stop <-chan struct{}) {
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-t.C:
+			reloaded, err := cr.Reload()
+			if err != nil {
+				logger.Error("reload certificate", "err", err)
+			} else if reloaded {
+				logger.Info("reloaded certificate", "file", cr.CertFile)
+			}
+		case <-stop:
+			return
+		}
+	}
+}
+
+func (cr *CertReloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	cr.m.RLock()
+	defer cr.m.RUnlock()
+	return cr.cert, nil
+}
+
+// TLSConfig serves the reloaded certificate, offering HTTP/2 so a browser's
+// event streams can share one connection
+func (cr *CertReloader) TLSConfig() *tls.Config {
+	return &tls.Config{
+		GetCertificate: cr.GetCertificate,
+		MinVersion:     tls.VersionTLS12,
+		NextProtos:     []string{"h2", "http/1.1"},
+	}
+}
+
+// RedirectHandler sends plain http requests to the same url on the https listener
+func RedirectHandler(httpsAddr string) http.Handler {
+	_, port, _ := net.SplitHostPort(httpsAddr)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		host := r.Host
+		if h, _, err := net.SplitHostPort(r.Host); err == nil {
+			host = h
+		}
+		if port != "" && port != "443" {
+			host = net.JoinHostPort(host, port)
+		}
+		http.Redirect(w, r, "https://"+host+r.URL.RequestURI(), http.StatusMovedPermanently)
+	})
+}
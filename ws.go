@@ -0,0 +1,186 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/websocket"
+	sh "github.com/murphysean/secrethitler"
+)
+
+const (
+	wsWriteWait  = 10 * time.Second
+	wsPongWait   = time.Minute
+	wsPingPeriod = wsPongWait * 9 / 10
+)
+
+// wsSubmission is a message from the client, an event to submit to the game
+type wsSubmission struct {
+	Ref  string          `json:"ref"`
+	Data json.RawMessage `json:"data"`
+}
+
+// checkWSOrigin allows same origin sockets, and those from origins listed by
+// name in cors-origins. Browsers send cookies on sockets from any site, so a
+// * doesn't count.
+func (ah *APIHandler) checkWSOrigin(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return true
+	}
+	if u, err := url.Parse(origin); err == nil && u.Host == r.Host {
+		return true
+	}
+	for _, o := range ah.Config.CORSOrigins {
+		if o == origin {
+			return true
+		}
+	}
+	return false
+}
+
+// GameSocketHandler is a websocket carrying the same frames as the event
+// stream, that also takes events from the client, acking each by its ref
+func (ah *APIHandler) GameSocketHandler(w http.ResponseWriter, r *http.Request) {
+	gameID := PathParam(r, "gameID")
+	AddLogFields(r, "gameID", gameID)
+
+	ah.m.RLock()
+	ret, ok := ah.ActiveGames[gameID]
+	ah.m.RUnlock()
+	if !ok {
+		//Finished games can still be replayed
+		f, err := ah.Store.OpenEventLog(gameID, 0)
+		if err != nil {
+			WriteError(w, NewAPIError(http.StatusNotFound, CodeNotFound, "Not Found"))
+			return
+		}
+		f.Close()
+	}
+	//Browsers can't set a Last-Event-Id header on a socket
+	leid, _ := strconv.Atoi(r.URL.Query().Get("lastEventId"))
+
+	upgrader := websocket.Upgrader{CheckOrigin: ah.checkWSOrigin}
+	conn, err := upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		//The upgrader has already answered
+		ah.logger(r).Warn("websocket upgrade", "err", err)
+		return
+	}
+	defer conn.Close()
+	conn.SetReadLimit(maxSmallBody)
+	conn.SetReadDeadline(time.Now().Add(wsPongWait))
+	conn.SetPongHandler(func(string) error {
+		return conn.SetReadDeadline(time.Now().Add(wsPongWait))
+	})
+
+	//Acks and errors for the client's messages, written by this goroutine
+	//along with everything else since a socket only takes one writer
+	acks := make(chan streamFrame, 16)
+	readDone := make(chan struct{})
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		defer close(readDone)
+		for {
+			_, b, err := conn.ReadMessage()
+			if err != nil {
+				return
+			}
+			select {
+			case acks <- ah.wsSubmit(r, ret, b):
+			case <-done:
+				return
+			}
+		}
+	}()
+
+	over := true
+	var g sh.Game
+	if ret != nil {
+		g = ah.gameState(gameID, ret)
+		over = g.WinningParty != ""
+	}
+	se := ah.newStreamEncoder(r, gameID, !over, wsWriter{conn: conn})
+	if ret != nil {
+		if err := se.Players(g); err != nil {
+			return
+		}
+	}
+	if ret == nil || over {
+		if err := se.Replay(leid, streamClosedID-1); err != nil {
+			ah.logger(r).Debug("websocket replay", "err", err)
+			return
+		}
+		se.Close()
+		conn.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, "game over"), time.Now().Add(wsWriteWait))
+		return
+	}
+
+	//Replay the log from the last event the client saw up to where the
+	//subscription takes over
+	sub := ah.Subscribe(gameID, ret, "ws")
+	defer sub.Close()
+	if err := se.Replay(leid, sub.Snapshot); err != nil {
+		ah.logger(r).Debug("websocket replay", "err", err)
+		return
+	}
+
+	ping := time.NewTicker(wsPingPeriod)
+	defer ping.Stop()
+	for {
+		select {
+		case e := <-sub.Events:
+			if e == nil {
+				return
+			}
+			if err := se.Live(e); err != nil {
+				return
+			}
+			if se.Finished() {
+				se.Close()
+				return
+			}
+		case f := <-acks:
+			if err := se.w.WriteFrame(f); err != nil {
+				return
+			}
+		case <-ping.C:
+			conn.SetWriteDeadline(time.Now().Add(wsWriteWait))
+			if err := conn.WriteMessage(websocket.PingMessage, nil); err != nil {
+				return
+			}
+		case n := <-sub.Resync:
+			ah.logger(r).Warn("stream fell behind", "dropped", n)
+			if err := se.Resync(ret, n); err != nil {
+				return
+			}
+		case <-ah.shutdown:
+			se.Restart()
+			conn.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseServiceRestart, "restarting"), time.Now().Add(wsWriteWait))
+			return
+		case <-readDone:
+			return
+		}
+	}
+}
+
+// wsSubmit submits an event sent over the socket, answering with an ack
+// carrying the event or an error carrying the APIError
+func (ah *APIHandler) wsSubmit(r *http.Request, ret *sh.SecretHitler, b []byte) streamFrame {
+	sub := wsSubmission{}
+	if err := json.Unmarshal(b, &sub); err != nil {
+		return streamFrame{Event: "error", Data: NewAPIError(http.StatusBadRequest, CodeInvalidJSON, err.Error())}
+	}
+	if ret == nil {
+		return streamFrame{Event: "error", Ref: sub.Ref, Data: NewAPIError(http.StatusConflict, CodeGameOver, "The game is over")}
+	}
+	e, err := ah.submitEvent(r, ret, sub.Data)
+	if err != nil {
+		return streamFrame{Event: "error", Ref: sub.Ref, Data: toAPIError(err)}
+	}
+	return streamFrame{Event: "ack", Ref: sub.Ref, Data: e}
+}